@@ -0,0 +1,311 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxNegativeTtl caps how long a negative answer is cached, as RFC 2308 suggests.
+const maxNegativeTtl = 3 * 60 * 60
+
+// staleLookupTimeout bounds looking up a stale answer once resolving ran out of time.
+const staleLookupTimeout = time.Second
+
+// Cache stores the responses to questions.
+type Cache interface {
+	// Store caches the records answering q, dropping any not on its CNAME chain
+	Store(ctx context.Context, q Question, answers []RR) error
+	// StoreNegative caches resp, an NXDOMAIN or NODATA response to q
+	StoreNegative(ctx context.Context, q Question, resp *Msg) error
+	// Lookup returns the response cached for q and counts the hit, nil if there is none
+	Lookup(ctx context.Context, q Question) (*CacheEntry, error)
+	// LookupStale is Lookup also returning records that expired within the stale
+	// window, without counting the hit
+	LookupStale(ctx context.Context, q Question) (*Msg, error)
+	Delete(ctx context.Context, q Question) error
+	// Purge drops every entry inv matches, stale ones included
+	Purge(ctx context.Context, inv Invalidation) error
+	// Iterate calls fn with every cached response until it returns false
+	Iterate(ctx context.Context, fn func(q Question, m *Msg) bool) error
+	// Stats returns what the cache counted since it was created
+	Stats() CacheStats
+}
+
+// CacheEntry is a response found in the cache.
+type CacheEntry struct {
+	Msg *Msg
+	// OrigTtl is the smallest TTL the records were cached with, Ttl the smallest left
+	OrigTtl, Ttl uint32
+	// Hits counts the lookups of q while it stayed cached, this one included
+	Hits int64
+}
+
+// ResolveFunc answers a question, as Resolver.Resolve and Forwarder.Resolve do.
+type ResolveFunc func(ctx context.Context, q Question) (*Msg, error)
+
+// CachingHandler is a Handler answering from Cache, and from Resolve on a miss,
+// caching what it returns. Concurrent misses for one question share a resolution.
+// When resolution fails, records the cache keeps past their expiry are served
+// instead (RFC 8767).
+//
+// Stale answers should carry the Stale Answer extended error (RFC 8914), which
+// needs EDNS0 this package doesn't support yet.
+type CachingHandler struct {
+	Cache   Cache
+	Resolve ResolveFunc
+	// PrefetchPercent refreshes an entry in the background when it is hit within the
+	// last PrefetchPercent of its original TTL, 0 never does
+	PrefetchPercent uint32
+	// PrefetchHits is how often an entry must have been hit to be prefetched
+	PrefetchHits int64
+	// Timeout bounds answering a query in ServeDNS, and a prefetch, 10s by default
+	Timeout time.Duration
+
+	mu          sync.Mutex
+	prefetching map[Question]bool
+	flights     map[Question]*flight
+}
+
+// flight is a resolution shared by concurrent lookups of the same question.
+type flight struct {
+	done    chan struct{}
+	resp    *Msg
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func (h *CachingHandler) ServeDNS(w ResponseWriter, r *Msg) {
+	m := new(Msg).SetReply(r)
+	m.RecursionAvailable = true
+
+	if len(r.Question) != 1 {
+		m.Rcode = RcodeFormatError
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout(h.Timeout))
+		resp, err := h.Lookup(ctx, r.Question[0])
+		cancel()
+		if err != nil {
+			log.Printf("Warning: looking up %v err: %v", r.Question[0], err)
+			m.Rcode = RcodeServerFailure
+		} else {
+			m.Rcode = resp.Rcode
+			m.Answer = resp.Answer
+			m.Ns = resp.Ns
+		}
+	}
+
+	err := w.WriteMsg(m)
+	if err != nil {
+		log.Printf("Warning: writing cached response err: %v", err)
+	}
+}
+
+// Lookup answers q from the cache or by resolving it.
+func (h *CachingHandler) Lookup(ctx context.Context, q Question) (*Msg, error) {
+	cached, err := h.Cache.Lookup(ctx, q)
+	if err != nil {
+		log.Printf("Warning: getting %v from cache err: %v", q, err)
+	}
+	if cached != nil {
+		if h.shouldPrefetch(cached) {
+			h.prefetch(q)
+		}
+		return cached.Msg, nil
+	}
+
+	resp, err := h.resolve(ctx, q)
+	if err == nil && resp.Rcode != RcodeServerFailure {
+		return resp, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("upstream answered SERVFAIL")
+	}
+
+	if ctx.Err() != nil {
+		// resolving took all the time there was, the cache can still answer
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), staleLookupTimeout)
+		defer cancel()
+	}
+	stale, staleErr := h.Cache.LookupStale(ctx, q)
+	if staleErr != nil || stale == nil {
+		return nil, err
+	}
+	log.Printf("Info: serving stale answer for %v, resolving failed: %v", q, err)
+	return stale, nil
+}
+
+func (h *CachingHandler) shouldPrefetch(entry *CacheEntry) bool {
+	if h.PrefetchPercent == 0 || entry.Hits < h.PrefetchHits {
+		return false
+	}
+	return uint64(entry.Ttl)*100 <= uint64(entry.OrigTtl)*uint64(h.PrefetchPercent)
+}
+
+// prefetch resolves q again in the background, unless that is already under way.
+func (h *CachingHandler) prefetch(q Question) {
+	h.mu.Lock()
+	if h.prefetching[q] {
+		h.mu.Unlock()
+		return
+	}
+	if h.prefetching == nil {
+		h.prefetching = map[Question]bool{}
+	}
+	h.prefetching[q] = true
+	h.mu.Unlock()
+
+	go func() {
+		defer func() {
+			h.mu.Lock()
+			delete(h.prefetching, q)
+			h.mu.Unlock()
+		}()
+
+		// the client's request may be done long before this one
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout(h.Timeout))
+		defer cancel()
+		_, err := h.resolve(ctx, q)
+		if err != nil {
+			log.Printf("Warning: prefetching %v err: %v", q, err)
+		}
+	}()
+}
+
+// resolve resolves q and caches the response, sharing both with concurrent lookups
+// of the same question, however its name is cased. Each caller gets a copy of the
+// response asking its own q, and stops waiting once its ctx is done, the resolution
+// itself once no caller is left waiting.
+func (h *CachingHandler) resolve(ctx context.Context, q Question) (*Msg, error) {
+	key := Question{Name: CanonicalName(q.Name), QType: q.QType, QClass: q.QClass}
+
+	h.mu.Lock()
+	f, ok := h.flights[key]
+	if !ok {
+		if h.flights == nil {
+			h.flights = map[Question]*flight{}
+		}
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		h.flights[key] = f
+		go h.fly(fctx, key, q, f)
+	}
+	f.waiters++
+	h.mu.Unlock()
+
+	select {
+	case <-f.done:
+		if f.err != nil {
+			return nil, f.err
+		}
+		resp, err := f.resp.Copy()
+		if err != nil {
+			return nil, fmt.Errorf("copying response err: %v", err)
+		}
+		if len(resp.Question) == 1 {
+			resp.Question[0] = q
+		}
+		return resp, nil
+	case <-ctx.Done():
+		h.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			// later lookups start over rather than get the cancelled result
+			if h.flights[key] == f {
+				delete(h.flights, key)
+			}
+		}
+		h.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (h *CachingHandler) fly(ctx context.Context, key Question, q Question, f *flight) {
+	defer f.cancel()
+
+	resp, err := h.Resolve(ctx, q)
+	if err == nil && resp.Rcode != RcodeServerFailure {
+		h.store(ctx, key, resp)
+	}
+
+	h.mu.Lock()
+	if h.flights[key] == f {
+		delete(h.flights, key)
+	}
+	h.mu.Unlock()
+
+	f.resp, f.err = resp, err
+	close(f.done)
+}
+
+func (h *CachingHandler) store(ctx context.Context, q Question, resp *Msg) {
+	var err error
+	if resp.Rcode == RcodeSuccess && hasData(resp.Answer, q) {
+		err = h.Cache.Store(ctx, q, resp.Answer)
+	} else {
+		err = h.Cache.StoreNegative(ctx, q, resp)
+	}
+	if err != nil {
+		log.Printf("Warning: caching %v err: %v", q, err)
+	}
+}
+
+// hasData reports whether answers hold records of the type q asks for, any type
+// for TypeANY.
+func hasData(answers []RR, q Question) bool {
+	for _, rr := range answers {
+		if rr.Header().Rrtype == q.QType || q.QType == TypeANY {
+			return true
+		}
+	}
+	return false
+}
+
+// negativeAnswer returns the CNAME chain and the SOA of resp, an NXDOMAIN or NODATA
+// response to q, with the TTL to cache them for: the SOA's negative TTL, the smaller
+// of its MINIMUM and its own TTL (RFC 2308), bounded by the chain. It is 0 if the
+// answer must not be cached.
+func negativeAnswer(q Question, resp *Msg) ([]RR, *SOA, uint32, error) {
+	answers, name, err := scrubAnswer(q, ".", resp.Answer)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("scrubbing answers err: %v", err)
+	}
+	// NODATA answers at most with the chain to the name without data
+	nodata := resp.Rcode == RcodeSuccess && (len(answers) == 0 ||
+		q.QType != TypeCNAME && answers[len(answers)-1].Header().Rrtype == TypeCNAME)
+	if resp.Rcode != RcodeNameError && !nodata {
+		return nil, nil, 0, fmt.Errorf("not a negative answer, rcode %d", resp.Rcode)
+	}
+
+	var soa *SOA
+	for _, rr := range resp.Ns {
+		if rr, ok := rr.(*SOA); ok && IsSubDomain(rr.Hdr.Name, name) {
+			soa = rr
+			break
+		}
+	}
+	if soa == nil {
+		// without the SOA the answer can't be cached (RFC 2308 section 5)
+		return nil, nil, 0, fmt.Errorf("no soa for %s in negative answer", name)
+	}
+
+	ttl := soa.Hdr.Ttl
+	if soa.MinTtl < ttl {
+		ttl = soa.MinTtl
+	}
+	if ttl > maxNegativeTtl {
+		ttl = maxNegativeTtl
+	}
+	// the answer is not negative any more once the chain to it expires
+	for _, a := range answers {
+		if a.Header().Ttl < ttl {
+			ttl = a.Header().Ttl
+		}
+	}
+	return answers, soa, ttl, nil
+}
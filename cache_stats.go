@@ -0,0 +1,261 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultStatsInterval = time.Minute
+
+// CacheStats count what a cache did since it was created.
+type CacheStats struct {
+	// Hits and Misses count the lookups, NegativeHits the hits answering NXDOMAIN or
+	// NODATA
+	Hits, Misses, NegativeHits uint64
+	// StaleHits counts the stale lookups answered with expired records
+	StaleHits uint64
+	// Evictions counts the entries the cache dropped on its own, for room or once
+	// too old to be served stale. Redis expiring keys goes uncounted.
+	Evictions uint64
+	Stores    uint64
+	// DecodeErrors counts the cached records that could not be read
+	DecodeErrors uint64
+	// Types break the lookups down by question type
+	Types map[uint16]TypeStats
+}
+
+// TypeStats count the lookups of questions of one type.
+type TypeStats struct {
+	Hits, Misses uint64
+}
+
+// HitRatio is the share of lookups that hit, 0 before any.
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// fields returns the counters of s by the names they are aggregated under in redis.
+func (s *CacheStats) fields() map[string]*uint64 {
+	return map[string]*uint64{
+		"hits":          &s.Hits,
+		"misses":        &s.Misses,
+		"negative_hits": &s.NegativeHits,
+		"stale_hits":    &s.StaleHits,
+		"evictions":     &s.Evictions,
+		"stores":        &s.Stores,
+		"decode_errors": &s.DecodeErrors,
+	}
+}
+
+// commonTypes is how many question types, all those below it, are counted without
+// a lock.
+const commonTypes = 256
+
+// cacheCounters are the CacheStats of a cache, counted concurrently.
+type cacheCounters struct {
+	hits, misses, negativeHits, staleHits, evictions, stores, decodeErrors uint64
+	// typeHits and typeMisses count the lookups of the common question types
+	typeHits, typeMisses [commonTypes]uint64
+
+	// mu guards types, counting the other question types
+	mu    sync.Mutex
+	types map[uint16]*TypeStats
+}
+
+// lookup counts a lookup of q finding m, nil for a miss.
+func (c *cacheCounters) lookup(q Question, m *Msg) {
+	hit := m != nil
+	if !hit {
+		atomic.AddUint64(&c.misses, 1)
+	} else {
+		atomic.AddUint64(&c.hits, 1)
+		if len(m.Ns) > 0 {
+			atomic.AddUint64(&c.negativeHits, 1)
+		}
+	}
+
+	if q.QType < commonTypes {
+		if hit {
+			atomic.AddUint64(&c.typeHits[q.QType], 1)
+		} else {
+			atomic.AddUint64(&c.typeMisses[q.QType], 1)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.types == nil {
+		c.types = map[uint16]*TypeStats{}
+	}
+	t := c.types[q.QType]
+	if t == nil {
+		t = &TypeStats{}
+		c.types[q.QType] = t
+	}
+	if hit {
+		t.Hits++
+	} else {
+		t.Misses++
+	}
+}
+
+func (c *cacheCounters) snapshot() CacheStats {
+	s := CacheStats{
+		Hits:         atomic.LoadUint64(&c.hits),
+		Misses:       atomic.LoadUint64(&c.misses),
+		NegativeHits: atomic.LoadUint64(&c.negativeHits),
+		StaleHits:    atomic.LoadUint64(&c.staleHits),
+		Evictions:    atomic.LoadUint64(&c.evictions),
+		Stores:       atomic.LoadUint64(&c.stores),
+		DecodeErrors: atomic.LoadUint64(&c.decodeErrors),
+		Types:        map[uint16]TypeStats{},
+	}
+	for qtype := range c.typeHits {
+		t := TypeStats{Hits: atomic.LoadUint64(&c.typeHits[qtype]), Misses: atomic.LoadUint64(&c.typeMisses[qtype])}
+		if t != (TypeStats{}) {
+			s.Types[uint16(qtype)] = t
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for qtype, t := range c.types {
+		s.Types[qtype] = *t
+	}
+	return s
+}
+
+// FlushStats adds what the client counted since it last did to the totals of all
+// the nodes sharing its redis, which FleetStats returns. It is FlushCacheStats of
+// the client, for nodes using it as their Cache.
+func (client *RedisClient) FlushStats(ctx context.Context) error {
+	return client.FlushCacheStats(ctx, client)
+}
+
+// FlushCacheStats adds what c, the Cache of this node such as a TieredCache in
+// front of the client, counted since it last did to the totals of all the nodes
+// sharing the client's redis. Only the cache the node looks up should be flushed,
+// not the client it keeps as L2 as well.
+func (client *RedisClient) FlushCacheStats(ctx context.Context, c Cache) error {
+	if !client.IsOk() {
+		return fmt.Errorf("client is nil")
+	}
+
+	client.flushMu.Lock()
+	defer client.flushMu.Unlock()
+
+	now := c.Stats()
+	was := client.flushed[c]
+	fields := now.fields()
+	flushed := was.fields()
+	_, err := client.Universal().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for name, v := range fields {
+			if d := *v - *flushed[name]; d > 0 {
+				pipe.HIncrBy(ctx, client.statsKey(), name, int64(d))
+			}
+		}
+		for qtype, t := range now.Types {
+			was := was.Types[qtype]
+			if d := t.Hits - was.Hits; d > 0 {
+				pipe.HIncrBy(ctx, client.statsKey(), fmt.Sprintf("hits|%d", qtype), int64(d))
+			}
+			if d := t.Misses - was.Misses; d > 0 {
+				pipe.HIncrBy(ctx, client.statsKey(), fmt.Sprintf("misses|%d", qtype), int64(d))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("flushing stats err: %v", err)
+	}
+	if client.flushed == nil {
+		client.flushed = map[Cache]CacheStats{}
+	}
+	client.flushed[c] = now
+	return nil
+}
+
+// FleetStats returns the totals the nodes sharing the client's redis flushed.
+func (client *RedisClient) FleetStats(ctx context.Context) (CacheStats, error) {
+	s := CacheStats{Types: map[uint16]TypeStats{}}
+	if !client.IsOk() {
+		return s, fmt.Errorf("client is nil")
+	}
+
+	totals, err := client.Universal().HGetAll(ctx, client.statsKey()).Result()
+	if err != nil {
+		return s, fmt.Errorf("getting stats err: %v", err)
+	}
+	fields := s.fields()
+	for name, total := range totals {
+		n, err := strconv.ParseUint(total, 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("invalid stat %s: %q", name, total)
+		}
+		if v, ok := fields[name]; ok {
+			*v = n
+			continue
+		}
+
+		name, typ, ok := strings.Cut(name, "|")
+		qtype, err := strconv.ParseUint(typ, 10, 16)
+		if !ok || err != nil {
+			continue
+		}
+		t := s.Types[uint16(qtype)]
+		switch name {
+		case "hits":
+			t.Hits = n
+		case "misses":
+			t.Misses = n
+		}
+		s.Types[uint16(qtype)] = t
+	}
+	return s, nil
+}
+
+// AggregateStats calls FlushStats every interval, a minute by default, until ctx is
+// done.
+func (client *RedisClient) AggregateStats(ctx context.Context, interval time.Duration) {
+	client.AggregateCacheStats(ctx, client, interval)
+}
+
+// AggregateCacheStats calls FlushCacheStats of c every interval, a minute by
+// default, until ctx is done.
+func (client *RedisClient) AggregateCacheStats(ctx context.Context, c Cache, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultStatsInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := client.FlushCacheStats(ctx, c)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
+
+// statsKey is the key of the hash of fleet totals. Not being of the
+// name|type|class form, it is never taken for a cached question.
+func (client *RedisClient) statsKey() string {
+	return client.keyPrefix() + "stats"
+}
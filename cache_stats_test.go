@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"testing"
+	"time"
+)
+
+func TestRedisCacheStats(t *testing.T) {
+	client := startTestRedis(t)
+	client.StaleWindow = time.Minute
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	q := testStoreA(t, client, "www.example.com.", 60)
+	nx := Question{Name: "nothere.example.com.", QType: TypeAAAA, QClass: ClassINET}
+	err := client.StoreRedisNegativeCache(ctx, nx, testNegativeResponse(nx, RcodeNameError, 3600, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := Question{Name: "bad.example.com.", QType: TypeA, QClass: ClassINET}
+	err = client.ZAdd(ctx, client.cacheKey(bad), &redis.Z{Score: float64(now.Unix() + 60), Member: "garbage"}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.GetRedisCacheByKey(ctx, q)
+	client.GetRedisCacheMsg(ctx, nx)
+	client.GetRedisCacheMsg(ctx, Question{Name: "other.example.com.", QType: TypeA, QClass: ClassINET})
+	client.GetRedisCacheMsg(ctx, bad)
+	setTestTime(t, now.Add(90*time.Second))
+	client.GetRedisCacheMsg(ctx, q)
+	client.GetRedisStaleMsg(ctx, q)
+	// reading the whole cache is no lookup
+	client.GetRedisCacheAllData(ctx)
+	client.Iterate(ctx, func(Question, *Msg) bool { return true })
+
+	s := client.Stats()
+	if s.Hits != 2 || s.Misses != 2 || s.NegativeHits != 1 || s.StaleHits != 1 || s.Stores != 2 || s.DecodeErrors != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+	if s.Types[TypeA] != (TypeStats{Hits: 1, Misses: 2}) || s.Types[TypeAAAA] != (TypeStats{Hits: 1}) {
+		t.Errorf("types = %+v", s.Types)
+	}
+	if s.HitRatio() != 0.5 {
+		t.Errorf("hit ratio = %v, want 0.5", s.HitRatio())
+	}
+}
+
+func TestLRUCacheStatsEvictions(t *testing.T) {
+	c := NewLRUCache(2*lruEntryOverhead, 1)
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		testStoreA(t, c, name, 60)
+	}
+	if s := c.Stats(); s.Evictions == 0 || s.Stores != 3 {
+		t.Errorf("stats = %+v, want evictions", s)
+	}
+}
+
+func TestFleetStats(t *testing.T) {
+	a := startTestRedis(t)
+	b := &RedisClient{}
+	err := b.InitRedis(context.Background(), a.Options().Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.CloseRedis)
+	ctx := context.Background()
+
+	q := testStoreA(t, a, "www.example.com.", 60)
+	a.GetRedisCacheByKey(ctx, q)
+	b.GetRedisCacheByKey(ctx, q)
+	b.GetRedisCacheByKey(ctx, Question{Name: "other.example.com.", QType: TypeA, QClass: ClassINET})
+
+	for _, c := range []*RedisClient{a, b, b} {
+		// flushing again adds nothing new
+		err = c.FlushStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := a.FleetStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Hits != 2 || s.Misses != 1 || s.Stores != 1 || s.Types[TypeA] != (TypeStats{Hits: 2, Misses: 1}) {
+		t.Errorf("fleet stats = %+v", s)
+	}
+}
+
+func TestFleetStatsOfTieredCache(t *testing.T) {
+	a, b := startTestTieredCaches(t)
+	ctx := context.Background()
+
+	q := testStoreA(t, a, "www.example.com.", 60)
+	// hits of a's l1 never reach redis
+	a.Lookup(ctx, q)
+	a.Lookup(ctx, q)
+	b.Lookup(ctx, q)
+	b.Lookup(ctx, Question{Name: "other.example.com.", QType: TypeA, QClass: ClassINET})
+
+	for _, c := range []*TieredCache{a, b} {
+		err := c.L2.FlushCacheStats(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := a.L2.FleetStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Hits != 3 || s.Misses != 1 || s.HitRatio() != 0.75 {
+		t.Errorf("fleet stats = %+v, want 3 hits and 1 miss", s)
+	}
+}
+
+func TestCacheCountersTypes(t *testing.T) {
+	var c cacheCounters
+	m := &Msg{}
+	c.lookup(Question{QType: TypeA}, m)
+	c.lookup(Question{QType: TypeA}, nil)
+	c.lookup(Question{QType: 65280}, m)
+
+	s := c.snapshot()
+	if len(s.Types) != 2 || s.Types[TypeA] != (TypeStats{Hits: 1, Misses: 1}) || s.Types[65280] != (TypeStats{Hits: 1}) {
+		t.Errorf("types = %+v", s.Types)
+	}
+}
@@ -0,0 +1,211 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachingHandlerServesStale(t *testing.T) {
+	client := startTestRedis(t)
+	client.StaleWindow = time.Hour
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	q := Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET}
+	up := true
+	h := &CachingHandler{
+		Cache: client,
+		Resolve: func(ctx context.Context, q Question) (*Msg, error) {
+			if !up {
+				return nil, fmt.Errorf("upstream unreachable")
+			}
+			rr := testRR(q.Name, TypeA, "192.0.2.1")
+			rr.Header().Ttl = 60
+			return &Msg{MsgHdr: MsgHdr{Response: true}, Question: []Question{q}, Answer: []RR{rr}}, nil
+		},
+	}
+
+	_, err := h.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up = false
+	setTestTime(t, now.Add(10*time.Minute))
+	m, err := h.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answer) != 1 || m.Answer[0].Header().Ttl != defaultStaleTtl {
+		t.Errorf("stale answer = %v", m.Answer)
+	}
+
+	// past the stale window
+	setTestTime(t, now.Add(2*time.Hour))
+	_, err = h.Lookup(context.Background(), q)
+	if err == nil {
+		t.Error("answer served past the stale window")
+	}
+}
+
+func TestCachingHandlerServeDNSTimesOut(t *testing.T) {
+	client := startTestRedis(t)
+	client.StaleWindow = time.Hour
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	q := testStoreA(t, client, "www.example.com.", 60)
+	h := &CachingHandler{
+		Cache:   client,
+		Timeout: 50 * time.Millisecond,
+		Resolve: func(ctx context.Context, q Question) (*Msg, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	// a stale answer is still served once resolving timed out
+	setTestTime(t, now.Add(10*time.Minute))
+	r := &Msg{Question: []Question{q}}
+	for _, want := range []int{1, 0} {
+		w := &recorder{}
+		start := time.Now()
+		h.ServeDNS(w, r)
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("answering took %v past its timeout", elapsed)
+		}
+		if len(w.msgs) != 1 || len(w.msgs[0].Answer) != want {
+			t.Errorf("got %v, want %d answers", w.msgs, want)
+		}
+
+		// past the stale window
+		setTestTime(t, now.Add(2*time.Hour))
+	}
+}
+
+func TestCachingHandlerPrefetches(t *testing.T) {
+	client := startTestRedis(t)
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	q := Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET}
+	var resolved int32
+	h := &CachingHandler{
+		Cache: client,
+		Resolve: func(ctx context.Context, q Question) (*Msg, error) {
+			n := atomic.AddInt32(&resolved, 1)
+			rr := testRR(q.Name, TypeA, fmt.Sprintf("192.0.2.%d", n))
+			rr.Header().Ttl = 100
+			return &Msg{MsgHdr: MsgHdr{Response: true}, Question: []Question{q}, Answer: []RR{rr}}, nil
+		},
+		PrefetchPercent: 10,
+		PrefetchHits:    2,
+	}
+
+	for _, d := range []time.Duration{0, 50 * time.Second, 95 * time.Second} {
+		setTestTime(t, now.Add(d))
+		m, err := h.Lookup(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Answer[0].(*A).A.String() != "192.0.2.1" {
+			t.Fatalf("answer after %v = %v, want the cached one", d, m.Answer)
+		}
+	}
+
+	// the last hit was the second one within the last 10% of the TTL
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		rrs, err := client.GetRedisCacheByKey(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rr := range rrs {
+			if rr.(*A).A.String() == "192.0.2.2" && rr.Header().Ttl == 100 {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("entry not prefetched, resolved %d times", atomic.LoadInt32(&resolved))
+}
+
+func TestCachingHandlerCoalescesMisses(t *testing.T) {
+	client := startTestRedis(t)
+	var resolved int32
+	release := make(chan struct{})
+	h := &CachingHandler{
+		Cache: client,
+		Resolve: func(ctx context.Context, q Question) (*Msg, error) {
+			atomic.AddInt32(&resolved, 1)
+			<-release
+			return &Msg{MsgHdr: MsgHdr{Response: true}, Question: []Question{q}, Answer: []RR{testRR(q.Name, TypeA, "192.0.2.1")}}, nil
+		},
+	}
+	waiters := func() int {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, f := range h.flights {
+			return f.waiters
+		}
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	resps := make(chan *Msg, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// differently cased names are the same question
+			name := "www.example.com."
+			if i%2 == 1 {
+				name = "WWW.example.com."
+			}
+			resp, err := h.Lookup(context.Background(), Question{Name: name, QType: TypeA, QClass: ClassINET})
+			errs <- err
+			if err == nil && resp.Question[0].Name != name {
+				t.Errorf("response asks %v, want %s", resp.Question[0], name)
+			}
+			resps <- resp
+		}(i)
+	}
+	for waiters() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a waiter giving up doesn't cancel the others
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := h.Lookup(ctx, Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET})
+	if err == nil {
+		t.Error("cancelled lookup succeeded")
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	close(resps)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	// every waiter may change its response
+	seen := map[RR]bool{}
+	for resp := range resps {
+		if resp == nil || len(resp.Answer) != 1 || seen[resp.Answer[0]] {
+			t.Errorf("waiters share the response %v", resp)
+			continue
+		}
+		seen[resp.Answer[0]] = true
+	}
+	if n := atomic.LoadInt32(&resolved); n != 1 {
+		t.Errorf("resolved %d times, want once", n)
+	}
+}
@@ -0,0 +1,272 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultClientTimeout  = 2 * time.Second
+	defaultClientAttempts = 3
+	// randomPortTries bounds the random source ports tried when they are in use
+	randomPortTries = 8
+)
+
+// Client sends queries upstream. The zero value queries over UDP and falls back to
+// TCP for truncated responses.
+type Client struct {
+	// Net is "udp" (default) or "tcp"
+	Net string
+	// Timeout bounds one attempt, the context bounds the whole exchange
+	Timeout time.Duration
+	// Attempts is how often a UDP query is sent before giving up on timeouts
+	Attempts int
+	// UDPSize is the largest UDP response read, MaxMsgSize by default
+	UDPSize int
+	// TsigKey signs queries carrying a TSIG and verifies their responses
+	TsigKey *TsigKey
+	// RandomPort sends each UDP query from a source port picked at random instead
+	// of one chosen by the system
+	RandomPort bool
+	// ExactCase only accepts responses echoing the question name byte for byte,
+	// which 0x20 randomization of the query name needs
+	ExactCase bool
+}
+
+// Exchange sends m to addr and returns the response matching its Id and question,
+// with the round trip time of the attempt that got it.
+func (c *Client) Exchange(ctx context.Context, m *Msg, addr string) (*Msg, time.Duration, error) {
+	data, mac, err := c.pack(m)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if c.Net == "tcp" {
+		return c.exchangeTCP(ctx, m, data, mac, addr)
+	}
+
+	attempts := c.Attempts
+	if attempts <= 0 {
+		attempts = defaultClientAttempts
+	}
+
+	var r *Msg
+	var rtt time.Duration
+	for i := 0; i < attempts; i++ {
+		r, rtt, err = c.exchangeUDP(ctx, m, data, mac, addr)
+		if err == nil || !isTimeout(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, rtt, err
+	}
+
+	if r.Truncated {
+		return c.exchangeTCP(ctx, m, data, mac, addr)
+	}
+	return r, rtt, nil
+}
+
+func (c *Client) pack(m *Msg) ([]byte, []byte, error) {
+	if c.TsigKey != nil && m.IsTsig() != nil {
+		return TsigSign(m, c.TsigKey, nil, false)
+	}
+	data, err := m.Pack()
+	return data, nil, err
+}
+
+func (c *Client) exchangeUDP(ctx context.Context, m *Msg, data []byte, mac []byte, addr string) (*Msg, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	conn, err := c.dialUDP(ctx, addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	_, err = conn.Write(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := c.UDPSize
+	if size <= 0 {
+		size = MaxMsgSize
+	}
+	buf := make([]byte, size)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			return nil, 0, err
+		}
+
+		// anything not answering our query may be spoofed, keep waiting for the real one
+		r, err := c.unpack(buf[:n], mac)
+		if err != nil || !isResponseTo(r, m, c.ExactCase) {
+			continue
+		}
+		return r, time.Since(start), nil
+	}
+}
+
+// dialUDP opens a socket for a single query.
+func (c *Client) dialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if !c.RandomPort {
+		return d.DialContext(ctx, "udp", addr)
+	}
+
+	var err error
+	for i := 0; i < randomPortTries; i++ {
+		d.LocalAddr = &net.UDPAddr{Port: randomPort()}
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, "udp", addr)
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return conn, err
+		}
+	}
+	return nil, err
+}
+
+func (c *Client) exchangeTCP(ctx context.Context, m *Msg, data []byte, mac []byte, addr string) (*Msg, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = writeTCPMsg(conn, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	buf, err := readTCPMsg(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, err
+	}
+
+	r, err := c.unpack(buf, mac)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !isResponseTo(r, m, c.ExactCase) {
+		return nil, 0, fmt.Errorf("response id %d or question does not match query", r.Id)
+	}
+	return r, time.Since(start), nil
+}
+
+func (c *Client) unpack(buf []byte, mac []byte) (*Msg, error) {
+	if mac != nil {
+		_, err := TsigVerify(buf, c.TsigKey, mac, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := new(Msg)
+	err := r.Unpack(buf)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultClientTimeout
+}
+
+// isResponseTo reports whether r answers the query m, comparing question names
+// byte for byte if exactCase.
+func isResponseTo(r *Msg, m *Msg, exactCase bool) bool {
+	if !r.Response || r.Id != m.Id {
+		return false
+	}
+	// servers may drop the question of a query they can't parse
+	if r.Rcode == RcodeFormatError && len(r.Question) == 0 {
+		return true
+	}
+	if len(r.Question) != len(m.Question) {
+		return false
+	}
+	for i, q := range m.Question {
+		rq := r.Question[i]
+		if rq.QType != q.QType || rq.QClass != q.QClass || !strings.EqualFold(rq.Name, q.Name) {
+			return false
+		}
+		if exactCase && rq.Name != q.Name {
+			return false
+		}
+	}
+	return true
+}
+
+// randomPort returns an unprivileged port from a cryptographic source.
+func randomPort() int {
+	var b [2]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic("dns: reading random port: " + err.Error())
+	}
+	return 1024 + int(binary.BigEndian.Uint16(b[:]))%(65536-1024)
+}
+
+// closeOnDone closes conn when ctx is cancelled so a blocked read returns.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+func isTimeout(err error) bool {
+	if ne, ok := err.(net.Error); ok {
+		return ne.Timeout()
+	}
+	return err == context.DeadlineExceeded
+}
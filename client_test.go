@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientExchange(t *testing.T) {
+	addr := startTestServer(t, &Server{Handler: testAnswerHandler(1)})
+
+	m := &Msg{MsgHdr: MsgHdr{Id: 1234, RecursionDesired: true}}
+	m.SetQuestion("www.example.", TypeA)
+	r, rtt, err := new(Client).Exchange(context.Background(), m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != m.Id || len(r.Answer) != 1 {
+		t.Errorf("unexpected response %+v", r)
+	}
+	if rtt <= 0 {
+		t.Errorf("rtt = %v", rtt)
+	}
+}
+
+func TestClientFallsBackToTCP(t *testing.T) {
+	addr := startTestServer(t, &Server{Handler: testAnswerHandler(60)})
+
+	m := &Msg{MsgHdr: MsgHdr{Id: 1}}
+	m.SetQuestion("www.example.", TypeA)
+	r, _, err := new(Client).Exchange(context.Background(), m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated || len(r.Answer) != 60 {
+		t.Errorf("tc=%v answers=%d, want the full tcp response", r.Truncated, len(r.Answer))
+	}
+}
+
+func TestClientRetriesOnTimeout(t *testing.T) {
+	var queries int32
+	addr := startTestServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Msg) {
+		// drop the first query
+		if atomic.AddInt32(&queries, 1) == 1 {
+			return
+		}
+		testAnswerHandler(1)(w, r)
+	})})
+
+	m := &Msg{MsgHdr: MsgHdr{Id: 2}}
+	m.SetQuestion("www.example.", TypeA)
+	c := &Client{Timeout: 100 * time.Millisecond, Attempts: 2}
+	_, _, err := c.Exchange(context.Background(), m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("server saw %d queries, want 2", n)
+	}
+}
+
+func TestClientIgnoresMismatchedId(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, MinMsgSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var q Msg
+		if q.Unpack(buf[:n]) != nil {
+			return
+		}
+		for _, id := range []uint16{q.Id + 1, q.Id} {
+			r := new(Msg).SetReply(&q)
+			r.Id = id
+			data, _ := r.Pack()
+			pc.WriteTo(data, addr)
+		}
+	}()
+
+	m := &Msg{MsgHdr: MsgHdr{Id: 3}}
+	m.SetQuestion("www.example.", TypeA)
+	r, _, err := (&Client{Timeout: time.Second}).Exchange(context.Background(), m, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != 3 {
+		t.Errorf("Id = %d, want 3", r.Id)
+	}
+}
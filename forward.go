@@ -0,0 +1,334 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+type ForwardStrategy int
+
+const (
+	ForwardRoundRobin ForwardStrategy = iota
+	ForwardRandom
+	ForwardLowestLatency
+	// ForwardSequential always prefers the first healthy upstream in the order they were added
+	ForwardSequential
+)
+
+const (
+	defaultMaxFails            = 3
+	defaultHealthCheckInterval = 5 * time.Second
+)
+
+// Upstream is a server queries are forwarded to, with the health the forwarder sees of it.
+type Upstream struct {
+	Addr string
+
+	mu    sync.Mutex
+	srtt  time.Duration
+	fails int
+	down  bool
+}
+
+// SRTT is the smoothed round trip time, 0 until the first answer.
+func (u *Upstream) SRTT() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.srtt
+}
+
+// Fails is the number of consecutive failed queries.
+func (u *Upstream) Fails() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.fails
+}
+
+func (u *Upstream) IsDown() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.down
+}
+
+// observe records the outcome of a query, marking u down after maxFails failures in a row.
+func (u *Upstream) observe(rtt time.Duration, err error, maxFails int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err != nil {
+		u.fails++
+		if u.fails >= maxFails && !u.down {
+			u.down = true
+			log.Printf("Warning: upstream %s marked down after %d failures: %v", u.Addr, u.fails, err)
+		}
+		return
+	}
+
+	if u.srtt == 0 {
+		u.srtt = rtt
+	} else {
+		u.srtt = (7*u.srtt + rtt) / 8
+	}
+	u.fails = 0
+	if u.down {
+		u.down = false
+		log.Printf("Info: upstream %s is up again", u.Addr)
+	}
+}
+
+// Forwarder is a Handler forwarding queries to a pool of upstreams. Upstreams that
+// fail MaxFails queries in a row are only tried once no healthy one is left, until
+// HealthCheck or a later answer brings them back.
+type Forwarder struct {
+	Strategy ForwardStrategy
+	// Client sends the queries, the zero Client if nil
+	Client *Client
+	// MaxFails is how many failures in a row mark an upstream down, 3 by default
+	MaxFails int
+	// MaxTries is how many upstreams a query is tried on, all by default
+	MaxTries int
+	// HealthCheckInterval is the time between probes, 5s by default
+	HealthCheckInterval time.Duration
+	// HealthCheckName is the name probed with an NS query, the root by default
+	HealthCheckName string
+	// Timeout bounds forwarding a query in ServeDNS, by default long enough for
+	// every attempt of the client on every upstream tried to time out
+	Timeout time.Duration
+
+	mu        sync.RWMutex
+	upstreams []*Upstream
+	next      int
+}
+
+func (f *Forwarder) AddUpstream(addr string) *Upstream {
+	u := &Upstream{Addr: addr}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.upstreams = append(f.upstreams, u)
+	return u
+}
+
+func (f *Forwarder) RemoveUpstream(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upstreams := make([]*Upstream, 0, len(f.upstreams))
+	for _, u := range f.upstreams {
+		if u.Addr != addr {
+			upstreams = append(upstreams, u)
+		}
+	}
+	f.upstreams = upstreams
+}
+
+func (f *Forwarder) Upstreams() []*Upstream {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return CloneSlice(f.upstreams)
+}
+
+func (f *Forwarder) ServeDNS(w ResponseWriter, r *Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout())
+	defer cancel()
+	resp, err := f.Forward(ctx, r)
+	if err != nil {
+		log.Printf("Warning: forwarding %v err: %v", r.Question, err)
+		resp = new(Msg).SetRcode(r, RcodeServerFailure)
+	}
+
+	err = w.WriteMsg(resp)
+	if err != nil {
+		log.Printf("Warning: writing forwarded response err: %v", err)
+	}
+}
+
+// Forward sends r to the upstreams in the order of the strategy until one answers.
+func (f *Forwarder) Forward(ctx context.Context, r *Msg) (*Msg, error) {
+	m := *r
+	if m.IsTsig() != nil {
+		// the TSIG is for us, not for the upstream
+		m.Extra = m.Extra[:len(m.Extra)-1]
+	}
+	// the client's id may be predictable, ours is not
+	m.Id = Id()
+
+	upstreams := f.order()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams")
+	}
+	tries := len(upstreams)
+	if f.MaxTries > 0 && f.MaxTries < tries {
+		tries = f.MaxTries
+	}
+
+	var err error
+	for _, u := range upstreams[:tries] {
+		var resp *Msg
+		var rtt time.Duration
+		resp, rtt, err = f.client().Exchange(ctx, &m, u.Addr)
+		if err == nil {
+			// another upstream may do better, and this one is failing
+			err = upstreamRcodeErr(u, resp)
+		}
+		if err == nil && len(m.Question) == 1 {
+			// the upstream is trusted for every zone, but not for answering another question
+			err = Scrub(m.Question[0], ".", resp)
+		}
+		u.observe(rtt, err, f.maxFails())
+		if err == nil {
+			resp.Id = r.Id
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("all upstreams failed, last err: %v", err)
+}
+
+// Resolve forwards a recursive query for q, so a Forwarder can back a CachingHandler.
+func (f *Forwarder) Resolve(ctx context.Context, q Question) (*Msg, error) {
+	m := &Msg{MsgHdr: MsgHdr{RecursionDesired: true}, Question: []Question{q}}
+	return f.Forward(ctx, m)
+}
+
+// order returns the upstreams in the order to try them, healthy ones first.
+func (f *Forwarder) order() []*Upstream {
+	f.mu.Lock()
+	upstreams := CloneSlice(f.upstreams)
+	start := f.next
+	f.next++
+	f.mu.Unlock()
+
+	if len(upstreams) == 0 {
+		return nil
+	}
+
+	switch f.Strategy {
+	case ForwardRoundRobin:
+		start %= len(upstreams)
+		upstreams = append(upstreams[start:], upstreams[:start]...)
+	case ForwardRandom:
+		rand.Shuffle(len(upstreams), func(i, j int) {
+			upstreams[i], upstreams[j] = upstreams[j], upstreams[i]
+		})
+	case ForwardLowestLatency:
+		srtt := make(map[*Upstream]time.Duration, len(upstreams))
+		for _, u := range upstreams {
+			srtt[u] = u.SRTT()
+		}
+		sort.SliceStable(upstreams, func(i, j int) bool {
+			return srtt[upstreams[i]] < srtt[upstreams[j]]
+		})
+	case ForwardSequential:
+	}
+
+	// down upstreams are the last resort
+	down := make(map[*Upstream]bool, len(upstreams))
+	for _, u := range upstreams {
+		down[u] = u.IsDown()
+	}
+	sort.SliceStable(upstreams, func(i, j int) bool {
+		return !down[upstreams[i]] && down[upstreams[j]]
+	})
+	return upstreams
+}
+
+// HealthCheck probes every upstream each HealthCheckInterval until ctx is done.
+func (f *Forwarder) HealthCheck(ctx context.Context) {
+	interval := f.HealthCheckInterval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, u := range f.Upstreams() {
+			wg.Add(1)
+			go func(u *Upstream) {
+				defer wg.Done()
+				f.Probe(ctx, u)
+			}(u)
+		}
+		wg.Wait()
+	}
+}
+
+// Probe sends one NS query for HealthCheckName to u and records the outcome, a
+// SERVFAIL or REFUSED answer as a failure.
+func (f *Forwarder) Probe(ctx context.Context, u *Upstream) error {
+	name := f.HealthCheckName
+	if name == "" {
+		name = "."
+	}
+	m := &Msg{MsgHdr: MsgHdr{Id: Id(), RecursionDesired: true}}
+	m.SetQuestion(Fqdn(name), TypeNS)
+
+	// one attempt, so a lost probe counts against the upstream
+	c := *f.client()
+	c.Attempts = 1
+	resp, rtt, err := c.Exchange(ctx, m, u.Addr)
+	if err == nil {
+		err = upstreamRcodeErr(u, resp)
+	}
+	u.observe(rtt, err, f.maxFails())
+	return err
+}
+
+// upstreamRcodeErr returns an error if u answered resp with SERVFAIL or REFUSED,
+// which count as failures of u as much as no answer does.
+func upstreamRcodeErr(u *Upstream, resp *Msg) error {
+	if resp.Rcode == RcodeServerFailure || resp.Rcode == RcodeRefused {
+		return fmt.Errorf("upstream %s answered rcode %d", u.Addr, resp.Rcode)
+	}
+	return nil
+}
+
+func (f *Forwarder) client() *Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return &Client{}
+}
+
+func (f *Forwarder) timeout() time.Duration {
+	if f.Timeout > 0 {
+		return f.Timeout
+	}
+	tries := len(f.Upstreams())
+	if f.MaxTries > 0 && f.MaxTries < tries {
+		tries = f.MaxTries
+	}
+	if tries == 0 {
+		tries = 1
+	}
+	c := f.client()
+	attempts := c.Attempts
+	if c.Net == "tcp" {
+		attempts = 1
+	} else if attempts <= 0 {
+		attempts = defaultClientAttempts
+	}
+	return time.Duration(tries*attempts) * c.timeout()
+}
+
+func (f *Forwarder) maxFails() int {
+	if f.MaxFails > 0 {
+		return f.MaxFails
+	}
+	return defaultMaxFails
+}
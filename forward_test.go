@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// deadUpstream returns the address of a closed UDP port.
+func deadUpstream(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
+
+func testForwardQuery() *Msg {
+	m := &Msg{MsgHdr: MsgHdr{Id: 77, RecursionDesired: true}}
+	m.SetQuestion("www.example.", TypeA)
+	return m
+}
+
+func TestForwarderSequentialFailover(t *testing.T) {
+	f := &Forwarder{
+		Strategy: ForwardSequential,
+		Client:   &Client{Timeout: 200 * time.Millisecond, Attempts: 1},
+		MaxFails: 2,
+	}
+	dead := f.AddUpstream(deadUpstream(t))
+	f.AddUpstream(startTestServer(t, &Server{Handler: testAnswerHandler(1)}))
+
+	for i := 0; i < 3; i++ {
+		r, err := f.Forward(context.Background(), testForwardQuery())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != 77 || len(r.Answer) != 1 {
+			t.Errorf("unexpected response %+v", r)
+		}
+	}
+	if !dead.IsDown() {
+		t.Error("dead upstream not marked down")
+	}
+	// once down it is skipped, so it isn't failing any more queries
+	if dead.Fails() != 2 {
+		t.Errorf("dead upstream fails = %d, want 2", dead.Fails())
+	}
+}
+
+func TestForwarderLowestLatency(t *testing.T) {
+	slow := startTestServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Msg) {
+		time.Sleep(30 * time.Millisecond)
+		testAnswerHandler(1)(w, r)
+	})})
+	fast := startTestServer(t, &Server{Handler: testAnswerHandler(1)})
+
+	f := &Forwarder{Strategy: ForwardRoundRobin}
+	f.AddUpstream(slow)
+	f.AddUpstream(fast)
+	// round robin measures both
+	for i := 0; i < 2; i++ {
+		_, err := f.Forward(context.Background(), testForwardQuery())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.Strategy = ForwardLowestLatency
+	order := f.order()
+	if order[0].Addr != fast {
+		t.Errorf("lowest latency picked %s (srtt %v) over %s (srtt %v)",
+			order[0].Addr, order[0].SRTT(), order[1].Addr, order[1].SRTT())
+	}
+}
+
+func TestForwarderProbeBringsUpstreamBack(t *testing.T) {
+	addr := startTestServer(t, &Server{Handler: testAnswerHandler(1)})
+	f := &Forwarder{MaxFails: 1}
+	u := f.AddUpstream(addr)
+	u.observe(0, context.DeadlineExceeded, f.MaxFails)
+	if !u.IsDown() {
+		t.Fatal("upstream not marked down")
+	}
+
+	err := f.Probe(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.IsDown() || u.SRTT() == 0 {
+		t.Errorf("down=%v srtt=%v after a successful probe", u.IsDown(), u.SRTT())
+	}
+}
+
+func TestForwarderProbeCountsServfail(t *testing.T) {
+	addr := startTestServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Msg) {
+		w.WriteMsg(new(Msg).SetRcode(r, RcodeServerFailure))
+	})})
+	f := &Forwarder{MaxFails: 1}
+	u := f.AddUpstream(addr)
+
+	err := f.Probe(context.Background(), u)
+	if err == nil {
+		t.Error("probe answered SERVFAIL succeeded")
+	}
+	if !u.IsDown() {
+		t.Error("upstream answering SERVFAIL not marked down")
+	}
+}
+
+func TestForwarderFailsOverOnServfail(t *testing.T) {
+	f := &Forwarder{Strategy: ForwardSequential}
+	failing := f.AddUpstream(startTestServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Msg) {
+		w.WriteMsg(new(Msg).SetRcode(r, RcodeServerFailure))
+	})}))
+	f.AddUpstream(startTestServer(t, &Server{Handler: testAnswerHandler(1)}))
+
+	r, err := f.Forward(context.Background(), testForwardQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != RcodeSuccess || len(r.Answer) != 1 {
+		t.Errorf("unexpected response %+v", r)
+	}
+	if failing.Fails() != 1 {
+		t.Errorf("servfailing upstream fails = %d, want 1", failing.Fails())
+	}
+}
+
+func TestForwarderServeDNSTimesOut(t *testing.T) {
+	f := &Forwarder{Timeout: 50 * time.Millisecond}
+	f.AddUpstream(startTestServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Msg) {
+		time.Sleep(time.Second)
+	})}))
+
+	w := &recorder{}
+	start := time.Now()
+	f.ServeDNS(w, testForwardQuery())
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("forwarding took %v past its timeout", elapsed)
+	}
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != RcodeServerFailure {
+		t.Errorf("got %v, want SERVFAIL", w.msgs)
+	}
+}
@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+)
+
+type InvalidationKind int
+
+const (
+	// InvalidateQuestion drops the entry of exactly the question
+	InvalidateQuestion InvalidationKind = iota
+	// InvalidateName drops the entries of every type and class of the name
+	InvalidateName
+	// InvalidateZone drops the entries of the name and every name below it
+	InvalidateZone
+)
+
+// Invalidation tells which cached entries are out of date.
+type Invalidation struct {
+	Kind InvalidationKind
+	// Question is the entry dropped, of which only the name counts for
+	// InvalidateName and InvalidateZone
+	Question Question
+}
+
+// Matches reports whether inv drops the entry of q.
+func (inv Invalidation) Matches(q Question) bool {
+	switch inv.Kind {
+	case InvalidateQuestion:
+		return q.QType == inv.Question.QType && q.QClass == inv.Question.QClass &&
+			CanonicalName(q.Name) == CanonicalName(inv.Question.Name)
+	case InvalidateName:
+		return CanonicalName(q.Name) == CanonicalName(inv.Question.Name)
+	case InvalidateZone:
+		return IsSubDomain(inv.Question.Name, q.Name)
+	}
+	return false
+}
+
+// invalidateAll is what a subscriber gets when it may have missed invalidations.
+var invalidateAll = Invalidation{Kind: InvalidateZone, Question: Question{Name: "."}}
+
+type invalidationMsg struct {
+	Node string
+	Invalidation
+}
+
+// PublishInvalidation tells the other nodes subscribed to invalidations to drop
+// the entries inv matches.
+func (client *RedisClient) PublishInvalidation(ctx context.Context, inv Invalidation) error {
+	if !client.IsOk() {
+		return fmt.Errorf("client is nil")
+	}
+
+	msg, err := json.Marshal(invalidationMsg{Node: client.nodeID(), Invalidation: inv})
+	if err != nil {
+		return fmt.Errorf("marshaling invalidation err: %v", err)
+	}
+	err = client.Universal().Publish(ctx, client.invalidationChannel(), string(msg)).Err()
+	if err != nil {
+		return fmt.Errorf("publishing invalidation err: %v", err)
+	}
+	return nil
+}
+
+// SubscribeInvalidations calls fn with the invalidations other nodes publish, until
+// ctx is done. The subscription survives lost connections, after which fn is told
+// to drop everything as invalidations may have been missed.
+func (client *RedisClient) SubscribeInvalidations(ctx context.Context, fn func(inv Invalidation)) error {
+	if !client.IsOk() {
+		return fmt.Errorf("client is nil")
+	}
+
+	node := client.nodeID()
+	sub := client.Universal().Subscribe(ctx, client.invalidationChannel())
+	defer sub.Close()
+
+	subscribed := false
+	ch := sub.ChannelWithSubscriptions(ctx, 100)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-ch:
+			if !ok {
+				return fmt.Errorf("invalidation subscription closed")
+			}
+
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				if msg.Kind != "subscribe" {
+					continue
+				}
+				// subscribed again after a reconnect
+				if subscribed {
+					log.Printf("Info: resubscribed to invalidations, dropping everything")
+					fn(invalidateAll)
+				}
+				subscribed = true
+			case *redis.Message:
+				var inv invalidationMsg
+				err := json.Unmarshal([]byte(msg.Payload), &inv)
+				if err != nil {
+					log.Printf("Warning: unmarshaling invalidation err: %v", err)
+					continue
+				}
+				if inv.Node != node {
+					fn(inv.Invalidation)
+				}
+			}
+		}
+	}
+}
+
+// nodeID returns the id telling the invalidations of this client from those of
+// other nodes.
+func (client *RedisClient) nodeID() string {
+	client.nodeOnce.Do(func() {
+		client.node = fmt.Sprintf("%04x%04x", Id(), Id())
+	})
+	return client.node
+}
+
+// invalidationChannel is where nodes sharing a redis tell each other which cached
+// entries changed.
+func (client *RedisClient) invalidationChannel() string {
+	return client.keyPrefix() + "invalidate"
+}
@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"testing"
+	"time"
+)
+
+func TestInvalidationMatches(t *testing.T) {
+	www := Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET}
+	tests := []struct {
+		inv  Invalidation
+		q    Question
+		want bool
+	}{
+		{Invalidation{InvalidateQuestion, www}, Question{"WWW.example.com.", TypeA, ClassINET}, true},
+		{Invalidation{InvalidateQuestion, www}, Question{"www.example.com.", TypeAAAA, ClassINET}, false},
+		{Invalidation{InvalidateName, www}, Question{"www.example.com.", TypeAAAA, ClassINET}, true},
+		{Invalidation{InvalidateName, www}, Question{"a.www.example.com.", TypeA, ClassINET}, false},
+		{Invalidation{InvalidateZone, Question{Name: "example.com."}}, Question{"a.www.example.com.", TypeA, ClassINET}, true},
+		{Invalidation{InvalidateZone, Question{Name: "example.com."}}, Question{"badexample.com.", TypeA, ClassINET}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.inv.Matches(tt.q); got != tt.want {
+			t.Errorf("%+v matches %v = %v, want %v", tt.inv, tt.q, got, tt.want)
+		}
+	}
+}
+
+// waitSubscribed waits for n subscribers to invalidations.
+func waitSubscribed(t *testing.T, client *RedisClient, n int64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		subs, err := client.PubSubNumSub(context.Background(), client.invalidationChannel()).Result()
+		if err == nil && subs[client.invalidationChannel()] >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("not subscribed to invalidations")
+}
+
+func receiveInvalidation(t *testing.T, ch chan Invalidation) Invalidation {
+	select {
+	case inv := <-ch:
+		return inv
+	case <-time.After(5 * time.Second):
+		t.Fatal("no invalidation received")
+	}
+	return Invalidation{}
+}
+
+func TestInvalidationLoopback(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var pub, sub RedisClient
+	for _, c := range []*RedisClient{&pub, &sub} {
+		err := c.InitRedis(ctx, mr.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.CloseRedis()
+	}
+
+	ch := make(chan Invalidation, 10)
+	go sub.SubscribeInvalidations(ctx, func(inv Invalidation) {
+		ch <- inv
+	})
+	waitSubscribed(t, &pub, 1)
+
+	// a node doesn't get its own invalidations
+	err := sub.PublishInvalidation(ctx, Invalidation{Kind: InvalidateName, Question: Question{Name: "own.example.com."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Invalidation{Kind: InvalidateZone, Question: Question{Name: "example.com."}}
+	err = pub.PublishInvalidation(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv := receiveInvalidation(t, ch); inv != want {
+		t.Errorf("received %+v, want %+v", inv, want)
+	}
+
+	// invalidations published while disconnected are lost, so everything goes
+	mr.Close()
+	err = mr.Restart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv := receiveInvalidation(t, ch); inv != invalidateAll {
+		t.Errorf("received %+v after reconnecting, want %+v", inv, invalidateAll)
+	}
+}
+
+func TestInvalidationHandMadeClients(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// clients set up by hand rather than through InitRedisWithOptions
+	pub := &RedisClient{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	sub := &RedisClient{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	defer pub.CloseRedis()
+	defer sub.CloseRedis()
+
+	ch := make(chan Invalidation, 10)
+	go sub.SubscribeInvalidations(ctx, func(inv Invalidation) {
+		ch <- inv
+	})
+	waitSubscribed(t, pub, 1)
+
+	want := Invalidation{Kind: InvalidateName, Question: Question{Name: "www.example.com."}}
+	err := pub.PublishInvalidation(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv := receiveInvalidation(t, ch); inv != want {
+		t.Errorf("received %+v, want %+v", inv, want)
+	}
+}
@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Sweep does for the cache what key TTLs cannot, going once over the cached keys
+// until ctx is done: keys without a TTL, as written before keys had one or
+// persisted by hand, lose the records too old to be served stale and get the TTL
+// of their last record. It returns how many records it removed. Every key stored
+// since has a TTL, so there is no need to sweep again and again.
+func (client *RedisClient) Sweep(ctx context.Context) (int, error) {
+	if !client.IsOk() {
+		return 0, fmt.Errorf("client is nil")
+	}
+
+	// 当前时间戳, less the time stale records are kept
+	expired := fmt.Sprintf("%d", timeNow().Unix()-int64(client.StaleWindow/time.Second))
+	removed := 0
+	err := client.scanQuestions(ctx, func(key string, q Question) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ttl, err := client.Universal().TTL(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("getting ttl of %s err: %v", key, err)
+		}
+		// -1 is no TTL, -2 no key any more
+		if ttl != -1 {
+			return nil
+		}
+
+		n, err := client.Universal().ZRemRangeByScore(ctx, key, "-inf", expired).Result()
+		if err != nil {
+			return fmt.Errorf("sweeping %s err: %v", key, err)
+		}
+		removed += int(n)
+
+		left, err := client.Universal().ZCard(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("counting records of %s err: %v", key, err)
+		}
+		if left > 0 {
+			return client.expireWithLast(ctx, key)
+		}
+		// redis deletes the emptied key, but not its hit count
+		atomic.AddUint64(&client.stats.evictions, 1)
+		err = client.Universal().Del(ctx, key+hitsKeySuffix).Err()
+		if err != nil {
+			return fmt.Errorf("deleting hits of %s err: %v", key, err)
+		}
+		return nil
+	})
+	return removed, err
+}
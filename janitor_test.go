@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"testing"
+	"time"
+)
+
+func TestRedisKeysExpire(t *testing.T) {
+	client := startTestRedis(t)
+	client.StaleWindow = time.Minute
+	ctx := context.Background()
+
+	q := testStoreA(t, client, "www.example.com.", 60)
+	ttl, err := client.TTL(ctx, client.cacheKey(q)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 2*time.Minute {
+		t.Errorf("key ttl = %v, want the record ttl and the stale window", ttl)
+	}
+}
+
+func TestMigrateRedisKeysSetsTTL(t *testing.T) {
+	client := startTestRedis(t)
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	old := `{"Name":"baidu.com","QType":1,"QClass":1}`
+	member := `{"Type":1,"Payload":{"Hdr":{"Name":"baidu.com.","Rrtype":1,"Class":1,"Ttl":60,"Rdlength":4},"A":"39.156.66.10"}}`
+	err := client.ZAdd(ctx, old, &redis.Z{Score: float64(now.Unix() + 60), Member: member}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.MigrateRedisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttl, err := client.TTL(ctx, client.cacheKey(Question{Name: "baidu.com", QType: TypeA, QClass: ClassINET})).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != time.Minute {
+		t.Errorf("migrated key ttl = %v, want its record's", ttl)
+	}
+}
+
+func TestSweepRemovesExpiredRecords(t *testing.T) {
+	client := startTestRedis(t)
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	expired := testStoreA(t, client, "old.example.com.", 60)
+	live := testStoreA(t, client, "www.example.com.", 3600)
+	_, err := client.GetRedisCacheEntry(ctx, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keys lost their ttl
+	for _, q := range []Question{expired, live} {
+		err = client.Persist(ctx, client.cacheKey(q)).Err()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setTestTime(t, now.Add(2*time.Minute))
+	removed, err := client.Sweep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d records, want 1", removed)
+	}
+	n, err := client.Exists(ctx, client.cacheKey(expired), client.cacheKey(expired)+hitsKeySuffix).Result()
+	if err != nil || n != 0 {
+		t.Errorf("%d keys of the expired entry left, err %v", n, err)
+	}
+	rrs, err := client.GetRedisCacheByKey(ctx, live)
+	if err != nil || len(rrs) != 1 {
+		t.Errorf("live entry = %v, %v", rrs, err)
+	}
+	ttl, err := client.TTL(ctx, client.cacheKey(live)).Result()
+	if err != nil || ttl != 3600*time.Second-2*time.Minute {
+		t.Errorf("live entry ttl = %v, %v, want what its record has left", ttl, err)
+	}
+}
+
+func TestSweepStopsWithContext(t *testing.T) {
+	client := startTestRedis(t)
+	testStoreA(t, client, "www.example.com.", 60)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := client.Sweep(ctx)
+	if err == nil {
+		t.Error("sweep went on after cancellation")
+	}
+}
@@ -0,0 +1,413 @@
+package dns
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLRUMaxBytes = 64 << 20
+	defaultLRUShards   = 16
+	// lruEntryOverhead is roughly what an entry takes beside its packed records
+	lruEntryOverhead = 200
+)
+
+// LRUCache is a Cache in memory, bounded by the size of the records it holds. It is
+// split into shards locked on their own, each evicting its least recently used
+// entries once over its share of the bound. An entry expires with its first record
+// and is dropped StaleWindow later, when looked up or evicted.
+type LRUCache struct {
+	// stats come first, aligned for their atomic counters
+	stats cacheCounters
+
+	// StaleWindow is how long records are kept after they expire, to be served when
+	// resolution fails (RFC 8767); 0 drops them on expiry
+	StaleWindow time.Duration
+	// StaleTtl is the TTL stale records are served with, 30s by default
+	StaleTtl uint32
+
+	shards []*lruShard
+}
+
+type lruShard struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	// order holds the *lruEntry values, most recently used first
+	order   *list.List
+	entries map[Question]*list.Element
+}
+
+// lruEntry is what is cached for a question, its records packed so they are
+// copied in and out and their size is known.
+type lruEntry struct {
+	q Question
+	// answers holds nAnswers records with the TTLs they were stored with
+	answers  []byte
+	nAnswers int
+	// soa is the packed SOA of a negative answer with its negative TTL
+	soa   []byte
+	rcode int
+	// stored is when the entry was stored, expires when its first record expires
+	stored, expires int64
+	hits            int64
+}
+
+// NewLRUCache returns an LRUCache holding up to maxBytes in shards, 64MB in 16
+// shards for 0.
+func NewLRUCache(maxBytes, shards int) *LRUCache {
+	if maxBytes <= 0 {
+		maxBytes = defaultLRUMaxBytes
+	}
+	if shards <= 0 {
+		shards = defaultLRUShards
+	}
+
+	c := &LRUCache{shards: make([]*lruShard, shards)}
+	for i := range c.shards {
+		c.shards[i] = &lruShard{
+			maxBytes: maxBytes / shards,
+			order:    list.New(),
+			entries:  map[Question]*list.Element{},
+		}
+	}
+	return c
+}
+
+func (c *LRUCache) Store(ctx context.Context, q Question, answers []RR) error {
+	answers, _, err := scrubAnswer(q, ".", answers)
+	if err != nil {
+		return fmt.Errorf("scrubbing answers err: %v", err)
+	}
+	if len(answers) == 0 {
+		// nothing to cache, but not to leave what was either
+		return c.Delete(ctx, q)
+	}
+
+	data, err := packRRs(answers)
+	if err != nil {
+		return fmt.Errorf("packing answers err: %v", err)
+	}
+	c.add(&lruEntry{q: lruKey(q), answers: data, nAnswers: len(answers)}, timeNow().Unix(), minTtl(answers))
+	return nil
+}
+
+func (c *LRUCache) StoreNegative(ctx context.Context, q Question, resp *Msg) error {
+	answers, soa, ttl, err := negativeAnswer(q, resp)
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		return c.Delete(ctx, q)
+	}
+
+	data, err := packRRs(answers)
+	if err != nil {
+		return fmt.Errorf("packing answers err: %v", err)
+	}
+	neg := *soa
+	neg.Hdr.Ttl = ttl
+	soaData, err := packRRs([]RR{&neg})
+	if err != nil {
+		return fmt.Errorf("packing soa err: %v", err)
+	}
+	c.add(&lruEntry{q: lruKey(q), answers: data, nAnswers: len(answers), soa: soaData, rcode: resp.Rcode}, timeNow().Unix(), ttl)
+	return nil
+}
+
+func (c *LRUCache) Lookup(ctx context.Context, q Question) (*CacheEntry, error) {
+	return c.lookup(q, false)
+}
+
+func (c *LRUCache) LookupStale(ctx context.Context, q Question) (*Msg, error) {
+	entry, err := c.lookup(q, true)
+	if entry == nil {
+		return nil, err
+	}
+	return entry.Msg, nil
+}
+
+func (c *LRUCache) Delete(ctx context.Context, q Question) error {
+	q = lruKey(q)
+	s := c.shard(q)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[q]; ok {
+		s.remove(el)
+	}
+	return nil
+}
+
+func (c *LRUCache) Purge(ctx context.Context, inv Invalidation) error {
+	if inv.Kind == InvalidateQuestion {
+		return c.Delete(ctx, inv.Question)
+	}
+
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for el := s.order.Front(); el != nil; {
+			next := el.Next()
+			if inv.Matches(el.Value.(*lruEntry).q) {
+				s.remove(el)
+			}
+			el = next
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *LRUCache) Stats() CacheStats {
+	return c.stats.snapshot()
+}
+
+func (c *LRUCache) Iterate(ctx context.Context, fn func(q Question, m *Msg) bool) error {
+	now := timeNow().Unix()
+	for _, s := range c.shards {
+		// a snapshot, so fn may use the cache
+		s.mu.Lock()
+		entries := make([]*lruEntry, 0, len(s.entries))
+		for el := s.order.Front(); el != nil; el = el.Next() {
+			entries = append(entries, el.Value.(*lruEntry))
+		}
+		s.mu.Unlock()
+
+		for _, e := range entries {
+			if now >= e.expires {
+				continue
+			}
+			entry, err := e.cacheEntry(e.q, now, false, c.staleTtl())
+			if err != nil {
+				return err
+			}
+			if entry != nil && !fn(e.q, entry.Msg) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// addEntry stores entry, found for q in another cache, as it is there: with its
+// original TTLs, as old as it is there and as often hit.
+func (c *LRUCache) addEntry(q Question, entry *CacheEntry) error {
+	var age uint32
+	if entry.OrigTtl > entry.Ttl {
+		age = entry.OrigTtl - entry.Ttl
+	}
+	pack := func(rrs []RR) ([]byte, error) {
+		rrs, err := copyRRs(rrs)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range rrs {
+			rr.Header().Ttl += age
+		}
+		return packRRs(rrs)
+	}
+
+	e := &lruEntry{q: lruKey(q), nAnswers: len(entry.Msg.Answer), rcode: entry.Msg.Rcode, hits: entry.Hits}
+	var err error
+	e.answers, err = pack(entry.Msg.Answer)
+	if err != nil {
+		return fmt.Errorf("packing answers err: %v", err)
+	}
+	if len(entry.Msg.Ns) > 0 {
+		e.soa, err = pack(entry.Msg.Ns[:1])
+		if err != nil {
+			return fmt.Errorf("packing soa err: %v", err)
+		}
+	}
+	c.add(e, timeNow().Unix()-int64(age), entry.OrigTtl)
+	return nil
+}
+
+// add stores e, stored at the Unix time stored to be answered with for ttl seconds,
+// as long as all its records last.
+func (c *LRUCache) add(e *lruEntry, stored int64, ttl uint32) {
+	e.stored = stored
+	e.expires = e.stored + int64(ttl)
+	s := c.shard(e.q)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[e.q]; ok {
+		// a refreshed entry stays as popular as it was
+		if hits := el.Value.(*lruEntry).hits; hits > e.hits {
+			e.hits = hits
+		}
+		s.remove(el)
+	}
+	s.entries[e.q] = s.order.PushFront(e)
+	s.bytes += e.size()
+
+	for s.bytes > s.maxBytes && s.order.Len() > 0 {
+		s.remove(s.order.Back())
+		atomic.AddUint64(&c.stats.evictions, 1)
+	}
+	atomic.AddUint64(&c.stats.stores, 1)
+}
+
+func (c *LRUCache) lookup(q Question, stale bool) (*CacheEntry, error) {
+	entry, expired, err := c.find(q, stale)
+	if err != nil {
+		atomic.AddUint64(&c.stats.decodeErrors, 1)
+		return nil, err
+	}
+
+	if !stale {
+		var m *Msg
+		if entry != nil {
+			m = entry.Msg
+		}
+		c.stats.lookup(q, m)
+	} else if entry != nil && expired {
+		atomic.AddUint64(&c.stats.staleHits, 1)
+	}
+	return entry, nil
+}
+
+// find returns the entry cached for q and whether it expired, nil if there is
+// none.
+func (c *LRUCache) find(q Question, stale bool) (*CacheEntry, bool, error) {
+	key := lruKey(q)
+	s := c.shard(key)
+	now := timeNow().Unix()
+
+	s.mu.Lock()
+	el, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil, false, nil
+	}
+	e := el.Value.(*lruEntry)
+	if now > e.expires+int64(c.StaleWindow/time.Second) {
+		s.remove(el)
+		s.mu.Unlock()
+		atomic.AddUint64(&c.stats.evictions, 1)
+		return nil, false, nil
+	}
+	if !stale && now >= e.expires {
+		s.mu.Unlock()
+		return nil, false, nil
+	}
+	if !stale {
+		e.hits++
+	}
+	s.order.MoveToFront(el)
+	s.mu.Unlock()
+
+	entry, err := e.cacheEntry(q, now, stale, c.staleTtl())
+	return entry, now >= e.expires, err
+}
+
+// has reports whether an entry for q can still be served, stale or not, without
+// counting a lookup or making it recently used.
+func (c *LRUCache) has(ctx context.Context, q Question) (bool, error) {
+	key := lruKey(q)
+	s := c.shard(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	return ok && timeNow().Unix() <= el.Value.(*lruEntry).expires+int64(c.StaleWindow/time.Second), nil
+}
+
+func (c *LRUCache) shard(q Question) *lruShard {
+	h := fnv.New32a()
+	h.Write([]byte(q.Name))
+	return c.shards[(h.Sum32()^uint32(q.QType)<<16^uint32(q.QClass))%uint32(len(c.shards))]
+}
+
+func (c *LRUCache) staleTtl() uint32 {
+	if c.StaleTtl > 0 {
+		return c.StaleTtl
+	}
+	return defaultStaleTtl
+}
+
+func (s *lruShard) remove(el *list.Element) {
+	e := s.order.Remove(el).(*lruEntry)
+	delete(s.entries, e.q)
+	s.bytes -= e.size()
+}
+
+// cacheEntry unpacks the records of e, the answer to q, with the TTL they have left
+// at now, nil if none is left. Expired records are kept with staleTtl if stale.
+func (e *lruEntry) cacheEntry(q Question, now int64, stale bool, staleTtl uint32) (*CacheEntry, error) {
+	answers, _, err := unpackRRSlice(e.answers, 0, e.nAnswers)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking answers err: %v", err)
+	}
+	var soa RR
+	if e.soa != nil {
+		rrs, _, err := unpackRRSlice(e.soa, 0, 1)
+		if err != nil {
+			return nil, fmt.Errorf("unpacking soa err: %v", err)
+		}
+		soa = rrs[0]
+	}
+
+	m := &Msg{MsgHdr: MsgHdr{Response: true, Rcode: e.rcode}, Question: []Question{q}}
+	entry := &CacheEntry{Msg: m, Hits: e.hits}
+	kept := 0
+	keep := func(rr RR) bool {
+		h := rr.Header()
+		origTtl := h.Ttl
+		left := int64(origTtl) - (now - e.stored)
+		if left > 0 {
+			h.Ttl = uint32(left)
+		} else if stale {
+			h.Ttl = staleTtl
+		} else {
+			return false
+		}
+
+		if kept == 0 || origTtl < entry.OrigTtl {
+			entry.OrigTtl = origTtl
+		}
+		if kept == 0 || h.Ttl < entry.Ttl {
+			entry.Ttl = h.Ttl
+		}
+		kept++
+		return true
+	}
+
+	for _, rr := range answers {
+		if keep(rr) {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if soa != nil && keep(soa) {
+		m.Ns = []RR{soa}
+	}
+	if kept == 0 {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+func (e *lruEntry) size() int {
+	return lruEntryOverhead + len(e.q.Name) + len(e.answers) + len(e.soa)
+}
+
+func minTtl(rrs []RR) uint32 {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// lruKey returns q with its name in canonical form, so lookups ignore its case.
+func lruKey(q Question) Question {
+	return Question{Name: CanonicalName(q.Name), QType: q.QType, QClass: q.QClass}
+}
@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testStoreA(t *testing.T, c Cache, name string, ttl uint32) Question {
+	q := Question{Name: name, QType: TypeA, QClass: ClassINET}
+	rr := testRR(name, TypeA, "192.0.2.1")
+	rr.Header().Ttl = ttl
+	err := c.Store(context.Background(), q, []RR{rr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	c := NewLRUCache(0, 0)
+	c.StaleWindow = time.Minute
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	testStoreA(t, c, "www.example.com.", 60)
+
+	setTestTime(t, now.Add(20*time.Second))
+	// lookups ignore the case of the name
+	entry, err := c.Lookup(ctx, Question{Name: "WWW.example.com.", QType: TypeA, QClass: ClassINET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Ttl != 40 || entry.OrigTtl != 60 || entry.Hits != 1 {
+		t.Fatalf("entry = %+v", entry)
+	}
+	if entry.Msg.Answer[0].Header().Ttl != 40 {
+		t.Errorf("answer = %v", entry.Msg.Answer)
+	}
+
+	setTestTime(t, now.Add(90*time.Second))
+	q := Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET}
+	entry, _ = c.Lookup(ctx, q)
+	if entry != nil {
+		t.Errorf("expired entry looked up: %+v", entry)
+	}
+	m, _ := c.LookupStale(ctx, q)
+	if m == nil || m.Answer[0].Header().Ttl != defaultStaleTtl {
+		t.Errorf("stale = %v", m)
+	}
+
+	setTestTime(t, now.Add(200*time.Second))
+	m, _ = c.LookupStale(ctx, q)
+	if m != nil {
+		t.Errorf("served stale past the window: %v", m)
+	}
+}
+
+func TestLRUCacheNegative(t *testing.T) {
+	c := NewLRUCache(0, 0)
+	ctx := context.Background()
+	q := Question{Name: "nothere.example.com.", QType: TypeA, QClass: ClassINET}
+
+	err := c.StoreNegative(ctx, q, testNegativeResponse(q, RcodeNameError, 3600, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := c.Lookup(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Msg.Rcode != RcodeNameError || len(entry.Msg.Ns) != 1 || entry.Msg.Ns[0].Header().Ttl != 300 {
+		t.Errorf("entry = %+v", entry)
+	}
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// room for about three entries in one shard
+	c := NewLRUCache(3*(lruEntryOverhead+60), 1)
+	ctx := context.Background()
+
+	first := testStoreA(t, c, "a.example.com.", 60)
+	second := testStoreA(t, c, "b.example.com.", 60)
+	testStoreA(t, c, "c.example.com.", 60)
+	// first is now more recently used than second
+	c.Lookup(ctx, first)
+	testStoreA(t, c, "d.example.com.", 60)
+
+	if entry, _ := c.Lookup(ctx, second); entry != nil {
+		t.Error("least recently used entry kept")
+	}
+	if entry, _ := c.Lookup(ctx, first); entry == nil {
+		t.Error("recently used entry evicted")
+	}
+}
+
+func TestLRUCacheDeleteAndIterate(t *testing.T) {
+	c := NewLRUCache(0, 4)
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		testStoreA(t, c, fmt.Sprintf("host%d.example.com.", i), 60)
+	}
+	c.Delete(ctx, Question{Name: "host3.example.com.", QType: TypeA, QClass: ClassINET})
+
+	seen := map[string]bool{}
+	err := c.Iterate(ctx, func(q Question, m *Msg) bool {
+		seen[q.Name] = len(m.Answer) == 1
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 9 || seen["host3.example.com."] {
+		t.Errorf("iterated %v", seen)
+	}
+}
+
+func TestLRUCacheStoreNothingDeletes(t *testing.T) {
+	c := NewLRUCache(0, 0)
+	ctx := context.Background()
+	q := testStoreA(t, c, "www.example.com.", 600)
+
+	// answers all off the question, as redis does
+	err := c.Store(ctx, q, []RR{testRR("other.example.com.", TypeA, "192.0.2.2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := c.Lookup(ctx, q); entry != nil {
+		t.Errorf("replaced entry still cached: %+v", entry)
+	}
+}
@@ -1,5 +1,10 @@
 package dns
 
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
 type Msg struct {
 	MsgHdr
 	Question []Question
@@ -81,6 +86,36 @@ func (h *Header) pack(buf []byte, off int) (int, error) {
 	return off, nil
 }
 
+func (h *Header) unpack(data []byte, off int) (int, error) {
+	var err error
+	h.Id, off, err = unpackUint16(data, off)
+	if err != nil {
+		return off, err
+	}
+	h.Bits, off, err = unpackUint16(data, off)
+	if err != nil {
+		return off, err
+	}
+	h.Qdcount, off, err = unpackUint16(data, off)
+	if err != nil {
+		return off, err
+	}
+	h.Ancount, off, err = unpackUint16(data, off)
+	if err != nil {
+		return off, err
+	}
+	h.Nscount, off, err = unpackUint16(data, off)
+	if err != nil {
+		return off, err
+	}
+	h.Arcount, off, err = unpackUint16(data, off)
+	if err != nil {
+		return off, err
+	}
+
+	return off, nil
+}
+
 func (msg *Msg) len() int {
 	l := HeaderSize
 	for _, q := range msg.Question {
@@ -159,29 +194,8 @@ func (msg *Msg) Pack() (buf []byte, err error) {
 }
 
 func (msg *Msg) Unpack(data []byte) (err error) {
-	off := 0
 	var dh Header
-	dh.Id, off, err = unpackUint16(data, off)
-	if err != nil {
-		return err
-	}
-	dh.Bits, off, err = unpackUint16(data, off)
-	if err != nil {
-		return err
-	}
-	dh.Qdcount, off, err = unpackUint16(data, off)
-	if err != nil {
-		return err
-	}
-	dh.Ancount, off, err = unpackUint16(data, off)
-	if err != nil {
-		return err
-	}
-	dh.Nscount, off, err = unpackUint16(data, off)
-	if err != nil {
-		return err
-	}
-	dh.Arcount, off, err = unpackUint16(data, off)
+	off, err := dh.unpack(data, 0)
 	if err != nil {
 		return err
 	}
@@ -229,6 +243,17 @@ func (msg *Msg) Unpack(data []byte) (err error) {
 	return nil
 }
 
+// Id returns a message id from a cryptographic source, so it can't be predicted by
+// anyone trying to spoof the response.
+func Id() uint16 {
+	var b [2]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic("dns: reading random id: " + err.Error())
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
 func (msg *Msg) SetQuestion(name string, qtype uint16) {
 	msg.Question = append(msg.Question, Question{
 		Name:   name,
@@ -236,3 +261,42 @@ func (msg *Msg) SetQuestion(name string, qtype uint16) {
 		QClass: ClassINET,
 	})
 }
+
+// SetReply turns msg into a response to request.
+func (msg *Msg) SetReply(request *Msg) *Msg {
+	msg.Id = request.Id
+	msg.Response = true
+	msg.Opcode = request.Opcode
+	msg.RecursionDesired = request.RecursionDesired
+	msg.Rcode = RcodeSuccess
+	if len(request.Question) > 0 {
+		msg.Question = []Question{request.Question[0]}
+	}
+	return msg
+}
+
+// Copy returns a deep copy of msg, to change without touching the original.
+func (msg *Msg) Copy() (*Msg, error) {
+	m := &Msg{MsgHdr: msg.MsgHdr, Question: append([]Question(nil), msg.Question...)}
+	var err error
+	if len(msg.Answer) > 0 {
+		m.Answer, err = copyRRs(msg.Answer)
+	}
+	if err == nil && len(msg.Ns) > 0 {
+		m.Ns, err = copyRRs(msg.Ns)
+	}
+	if err == nil && len(msg.Extra) > 0 {
+		m.Extra, err = copyRRs(msg.Extra)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetRcode turns msg into a response to request with rcode.
+func (msg *Msg) SetRcode(request *Msg, rcode int) *Msg {
+	msg.SetReply(request)
+	msg.Rcode = rcode
+	return msg
+}
@@ -3,7 +3,6 @@ package dns
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
 	"net"
 	"strings"
 )
@@ -42,7 +41,7 @@ func packDataA(a net.IP, msg []byte, off int) (off1 int, err error) {
 func packDataAAAA(a net.IP, msg []byte, off int) (off1 int, err error) {
 	switch len(a) {
 	case net.IPv6len:
-		if off+net.IPv4len > len(msg) {
+		if off+net.IPv6len > len(msg) {
 			return len(msg), fmt.Errorf("overflow packing a")
 		}
 		copy(msg[off:], a.To16())
@@ -56,8 +55,12 @@ func packDataAAAA(a net.IP, msg []byte, off int) (off1 int, err error) {
 	return off, nil
 }
 
+// packDomainName packs name as fully qualified. Compression only points at an
+// earlier suffix with the very same bytes, so every name keeps its case on the wire,
+// as the 0x20 randomization of queries relies on.
 func packDomainName(name string, msg []byte, off int, compression map[string]uint16) (int, error) {
 	var begin int
+	name = Fqdn(name)
 
 	pointer := -1
 loop:
@@ -79,9 +82,13 @@ loop:
 			}
 
 			// store label
+			if labelLen > 63 {
+				return len(msg), fmt.Errorf("label too long packing domain name")
+			}
+			if off+1+labelLen > len(msg) {
+				return len(msg), fmt.Errorf("overflow packing domain name")
+			}
 			msg[off] = byte(labelLen)
-			ss := name[begin:i]
-			_ = ss
 			copy(msg[off+1:], name[begin:i])
 
 			off += 1 + labelLen
@@ -94,12 +101,10 @@ loop:
 	}
 
 	if pointer != -1 {
-		binary.BigEndian.PutUint16(msg[off:], uint16(pointer|0xC000))
-		return off + 2, nil
+		return packUint16(uint16(pointer|0xC000), msg, off)
 	}
 
-	msg[off] = 0
-	return off + 1, nil
+	return packUint8(0, msg, off)
 }
 
 func isRootLabel(s string, off, end int) bool {
@@ -107,12 +112,14 @@ func isRootLabel(s string, off, end int) bool {
 }
 
 func unpackDomainName(buf []byte, off int) (string, int, error) {
-	// TODO
 	var s []byte
 	ptr := 0
 	off1 := 0
 loop:
 	for {
+		if off >= len(buf) {
+			return "", len(buf), fmt.Errorf("overflow unpacking domain name")
+		}
 		c := int(buf[off])
 		off++
 		switch c & 0xC0 {
@@ -121,6 +128,9 @@ loop:
 			if c == 0x00 {
 				break loop
 			}
+			if off+c > len(buf) {
+				return "", len(buf), fmt.Errorf("overflow unpacking domain name")
+			}
 			for _, b := range buf[off : off+c] {
 				s = append(s, b)
 			}
@@ -128,7 +138,9 @@ loop:
 			off += c
 		case 0xC0:
 			// pointer
-			//c1 := int(buf[off])
+			if off >= len(buf) {
+				return "", len(buf), fmt.Errorf("overflow unpacking domain name")
+			}
 			c1 := uint16(c)<<8 | uint16(buf[off])
 			off++
 			if ptr == 0 {
@@ -138,6 +150,8 @@ loop:
 				return "", 0, fmt.Errorf("infinite loop")
 			}
 			off = int(c1 & 0x3FFF)
+		default:
+			return "", len(buf), fmt.Errorf("bad label type %#x", c&0xC0)
 		}
 	}
 	if ptr == 0 {
@@ -151,6 +165,15 @@ loop:
 	return string(s), off1, nil
 }
 
+func packUint8(i uint8, buf []byte, off int) (int, error) {
+	if off+1 > len(buf) {
+		return len(buf), fmt.Errorf("overflow packing uint8")
+	}
+
+	buf[off] = i
+	return off + 1, nil
+}
+
 func packUint16(i uint16, buf []byte, off int) (int, error) {
 	if off+2 > len(buf) {
 		return len(buf), fmt.Errorf("overflow packing uint16")
@@ -169,6 +192,25 @@ func packUint32(i uint32, buf []byte, off int) (int, error) {
 	return off + 4, nil
 }
 
+func packUint48(i uint64, buf []byte, off int) (int, error) {
+	if off+6 > len(buf) {
+		return len(buf), fmt.Errorf("overflow packing uint48")
+	}
+
+	binary.BigEndian.PutUint16(buf[off:], uint16(i>>32))
+	binary.BigEndian.PutUint32(buf[off+2:], uint32(i))
+	return off + 6, nil
+}
+
+func packBytes(b []byte, buf []byte, off int) (int, error) {
+	if off+len(b) > len(buf) {
+		return len(buf), fmt.Errorf("overflow packing bytes")
+	}
+
+	copy(buf[off:], b)
+	return off + len(b), nil
+}
+
 func packRRSlice(rrs []RR, buf []byte, off int, compression map[string]uint16) (off1 int, err error) {
 	for _, rr := range rrs {
 		off, err = packDomainName(rr.Header().Name, buf, off, compression)
@@ -210,6 +252,13 @@ func packRRSlice(rrs []RR, buf []byte, off int, compression map[string]uint16) (
 	return off, nil
 }
 
+func unpackUint8(buf []byte, off int) (uint8, int, error) {
+	if off+1 > len(buf) {
+		return 0, len(buf), fmt.Errorf("overflow unpacking uint8")
+	}
+	return buf[off], off + 1, nil
+}
+
 func unpackUint16(buf []byte, off int) (uint16, int, error) {
 	if off+2 > len(buf) {
 		return 0, len(buf), fmt.Errorf("overflow unpacking uint16")
@@ -224,6 +273,44 @@ func unpackUint32(buf []byte, off int) (uint32, int, error) {
 	return binary.BigEndian.Uint32(buf[off:]), off + 4, nil
 }
 
+func unpackUint48(buf []byte, off int) (uint64, int, error) {
+	if off+6 > len(buf) {
+		return 0, len(buf), fmt.Errorf("overflow unpacking uint48")
+	}
+	return uint64(binary.BigEndian.Uint16(buf[off:]))<<32 | uint64(binary.BigEndian.Uint32(buf[off+2:])), off + 6, nil
+}
+
+func unpackBytes(buf []byte, off int, l int) ([]byte, int, error) {
+	if l < 0 || off+l > len(buf) {
+		return nil, len(buf), fmt.Errorf("overflow unpacking bytes")
+	}
+	return CloneSlice(buf[off : off+l]), off + l, nil
+}
+
+// packRRs packs rrs on their own, as caches keep them.
+func packRRs(rrs []RR) ([]byte, error) {
+	l := 0
+	for _, rr := range rrs {
+		l += rr.len()
+	}
+	buf := make([]byte, l)
+	off, err := packRRSlice(rrs, buf, 0, make(map[string]uint16))
+	if err != nil {
+		return nil, err
+	}
+	return buf[:off], nil
+}
+
+// copyRRs returns deep copies of rrs, to change without touching the originals.
+func copyRRs(rrs []RR) ([]RR, error) {
+	data, err := packRRs(rrs)
+	if err != nil {
+		return nil, err
+	}
+	copies, _, err := unpackRRSlice(data, 0, len(rrs))
+	return copies, err
+}
+
 func unpackRRSlice(data []byte, off int, count int) ([]RR, int, error) {
 	var err error
 	var res []RR
@@ -252,6 +339,9 @@ func unpackRRSlice(data []byte, off int, count int) ([]RR, int, error) {
 		}
 
 		end := off + int(rh.Rdlength)
+		if end > len(data) {
+			return nil, len(data), fmt.Errorf("overflow unpacking rdata")
+		}
 
 		var rr RR
 		rr, off, err = unpackRR(rh, data, off)
@@ -274,14 +364,8 @@ func unpackRRSlice(data []byte, off int, count int) ([]RR, int, error) {
 func unpackRR(rh RR_Header, data []byte, off int) (RR, int, error) {
 	var err error
 
-	var rr RR
-	if rrFunc, ok := TypeToRR[rh.Rrtype]; ok {
-		rr = rrFunc()
-		*rr.Header() = rh
-	} else {
-		log.Printf("unsupported rr type %d", rh.Rrtype)
-		return nil, off + int(rh.Rdlength), nil
-	}
+	rr := newRR(rh.Rrtype)
+	*rr.Header() = rh
 
 	if rh.Rdlength == 0 {
 		return rr, off, nil
@@ -298,9 +382,15 @@ func unpackRR(rh RR_Header, data []byte, off int) (RR, int, error) {
 func unpackTxt(msg []byte, off int, end int) ([]string, int, error) {
 	var txt []string
 
+	if end > len(msg) {
+		return nil, len(msg), fmt.Errorf("overflow unpacking txt")
+	}
 	for off < end {
 		l := int(msg[off])
 		off++
+		if off+l > end {
+			return nil, len(msg), fmt.Errorf("overflow unpacking txt")
+		}
 		t := string(msg[off : off+l])
 		txt = append(txt, t)
 		off += l
@@ -316,6 +406,9 @@ func unpackTxt(msg []byte, off int, end int) ([]string, int, error) {
 func packTxt(txt []string, msg []byte, off int) (off1 int, err error) {
 	for _, t := range txt {
 		l := len(t)
+		if l > 255 || off+1+l > len(msg) {
+			return len(msg), fmt.Errorf("overflow packing txt")
+		}
 		msg[off] = uint8(l)
 		off++
 		copy(msg[off:], t)
@@ -334,3 +427,12 @@ func getDomainNameLen(domain string) int {
 
 	return l + 1
 }
+
+func getTxtLen(txt []string) int {
+	l := 0
+	for _, t := range txt {
+		l += 1 + len(t)
+	}
+
+	return l
+}
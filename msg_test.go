@@ -130,15 +130,25 @@ func TestTtt(t *testing.T) {
 }
 
 func TestGetRedisCacheByKey(t *testing.T) {
-	var c RedisClient
+	c := startTestRedis(t)
 	ctx := context.Background()
-	c.InitRedis(ctx, "localhost:6379")
-
-	c.GetRedisCacheByKey(ctx, Question{
+	q := Question{
 		Name:   "baidu.com",
 		QType:  1,
 		QClass: 1,
-	})
+	}
+
+	err := c.StoreRedisCache(ctx, q, []RR{testRR("baidu.com.", TypeA, "39.156.66.10")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs, err := c.GetRedisCacheByKey(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 {
+		t.Errorf("cached %v", rrs)
+	}
 }
 
 func TestPackTxt(t *testing.T) {
@@ -172,3 +182,32 @@ func TestPackDataAAAA(t *testing.T) {
 	b := make([]byte, 100)
 	packDataAAAA(a, b, 0)
 }
+
+func TestPackPreservesCase(t *testing.T) {
+	m := &Msg{}
+	m.SetQuestion("wWw.ExAmPle.com.", TypeA)
+	m.Answer = []RR{
+		&CNAME{Hdr: RR_Header{Name: "www.example.com.", Rrtype: TypeCNAME, Class: ClassINET}, Target: "WWW.EXAMPLE.com."},
+		// not fully qualified
+		&A{Hdr: RR_Header{Name: "www.example.net", Rrtype: TypeA, Class: ClassINET}, A: net.IPv4(192, 0, 2, 1).To4()},
+	}
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(Msg)
+	err = r.Unpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Question[0].Name != "wWw.ExAmPle.com." {
+		t.Errorf("question name = %s", r.Question[0].Name)
+	}
+	if r.Answer[0].Header().Name != "www.example.com." || r.Answer[0].(*CNAME).Target != "WWW.EXAMPLE.com." {
+		t.Errorf("cname = %v", r.Answer[0])
+	}
+	if r.Answer[1].Header().Name != "www.example.net." {
+		t.Errorf("a owner = %s", r.Answer[1].Header().Name)
+	}
+}
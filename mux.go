@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"log"
+	"sync"
+)
+
+// ServeMux routes a query to the handler of the longest zone its question name is
+// in, case-insensitively. Zones can be added and removed while serving; queries in
+// no zone go to the default handler, or are refused without one.
+type ServeMux struct {
+	mu             sync.RWMutex
+	zones          map[string]Handler
+	defaultHandler Handler
+}
+
+func (mux *ServeMux) Handle(zone string, handler Handler) {
+	if handler == nil {
+		panic("dns: nil handler")
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if mux.zones == nil {
+		mux.zones = make(map[string]Handler)
+	}
+	mux.zones[CanonicalName(zone)] = handler
+}
+
+func (mux *ServeMux) HandleFunc(zone string, handler func(ResponseWriter, *Msg)) {
+	mux.Handle(zone, HandlerFunc(handler))
+}
+
+func (mux *ServeMux) HandleRemove(zone string) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	delete(mux.zones, CanonicalName(zone))
+}
+
+// HandleDefault sets the handler of names in no zone, nil refuses them.
+func (mux *ServeMux) HandleDefault(handler Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.defaultHandler = handler
+}
+
+// Match returns the handler of the longest zone name is in, or the default handler.
+func (mux *ServeMux) Match(name string) Handler {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	name = CanonicalName(name)
+	off := 0
+	for {
+		if h, ok := mux.zones[name[off:]]; ok {
+			return h
+		}
+		next := off
+		for next < len(name) && name[next] != '.' {
+			next++
+		}
+		if next+1 >= len(name) {
+			break
+		}
+		off = next + 1
+	}
+	if h, ok := mux.zones["."]; ok {
+		return h
+	}
+
+	return mux.defaultHandler
+}
+
+func (mux *ServeMux) ServeDNS(w ResponseWriter, r *Msg) {
+	var h Handler
+	if len(r.Question) == 1 {
+		h = mux.Match(r.Question[0].Name)
+	}
+	if h == nil {
+		err := w.WriteMsg(new(Msg).SetRcode(r, RcodeRefused))
+		if err != nil {
+			log.Printf("Warning: writing refused err: %v", err)
+		}
+		return
+	}
+
+	h.ServeDNS(w, r)
+}
@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+// recorder is a ResponseWriter keeping the written messages.
+type recorder struct {
+	msgs []*Msg
+}
+
+func (w *recorder) LocalAddr() net.Addr         { return &net.UDPAddr{} }
+func (w *recorder) RemoteAddr() net.Addr        { return &net.UDPAddr{} }
+func (w *recorder) WriteMsg(m *Msg) error       { w.msgs = append(w.msgs, m); return nil }
+func (w *recorder) Write(b []byte) (int, error) { return len(b), nil }
+func (w *recorder) TsigStatus() error           { return nil }
+func (w *recorder) Close() error                { return nil }
+
+func testRcodeHandler(rcode int) HandlerFunc {
+	return func(w ResponseWriter, r *Msg) {
+		w.WriteMsg(new(Msg).SetRcode(r, rcode))
+	}
+}
+
+func TestServeMuxLongestZone(t *testing.T) {
+	var mux ServeMux
+	mux.Handle("corp.internal.", testRcodeHandler(1))
+	mux.Handle("db.corp.internal", testRcodeHandler(2))
+	mux.Handle("in-addr.arpa.", testRcodeHandler(3))
+	mux.HandleDefault(testRcodeHandler(4))
+
+	tests := map[string]int{
+		"www.corp.internal.":        1,
+		"corp.internal.":            1,
+		"primary.DB.Corp.Internal.": 2,
+		"1.2.0.192.in-addr.arpa.":   3,
+		"www.example.com.":          4,
+		"xcorp.internal.":           4,
+	}
+	for name, rcode := range tests {
+		w := &recorder{}
+		r := new(Msg)
+		r.SetQuestion(name, TypeA)
+		mux.ServeDNS(w, r)
+		if len(w.msgs) != 1 || w.msgs[0].Rcode != rcode {
+			t.Errorf("%s: got %v, want rcode %d", name, w.msgs, rcode)
+		}
+	}
+}
+
+func TestServeMuxRemoveAndRefuse(t *testing.T) {
+	var mux ServeMux
+	mux.Handle("corp.internal.", testRcodeHandler(1))
+	mux.HandleRemove("CORP.internal")
+
+	w := &recorder{}
+	r := new(Msg)
+	r.SetQuestion("www.corp.internal.", TypeA)
+	mux.ServeDNS(w, r)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != RcodeRefused {
+		t.Errorf("got %v, want refused", w.msgs)
+	}
+
+	mux.Handle(".", testRcodeHandler(5))
+	if h := mux.Match("www.corp.internal."); h == nil {
+		t.Error("root zone did not match")
+	}
+}
@@ -3,49 +3,87 @@ package dns
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type wrappedObj struct {
-	Type    uint16
-	Payload interface{}
-}
+const (
+	// defaultStaleTtl is the TTL stale records are served with, as RFC 8767 suggests
+	defaultStaleTtl  = 30
+	defaultKeyPrefix = "spirit_dns:"
+	// hitsKeySuffix is put after the key of a question to count its cache hits
+	hitsKeySuffix = "|hits"
+)
 
 type RedisClient struct {
+	// stats come first, aligned for their atomic counters
+	stats cacheCounters
+
+	// Client is the client of a single server or Sentinel master, nil for a Cluster;
+	// Universal returns the client whatever the mode. The methods of Client that
+	// RedisClient has through it panic in Cluster mode, call them on Universal.
 	*redis.Client
+	// KeyPrefix namespaces every key the client uses, "spirit_dns:" by default. The
+	// key of a question follows it with "name|type|class", the name in canonical form
+	KeyPrefix string
+	// StaleWindow is how long records are kept after they expire, to be served when
+	// resolution fails (RFC 8767); 0 drops them on expiry
+	StaleWindow time.Duration
+	// StaleTtl is the TTL stale records are served with, 30s by default
+	StaleTtl uint32
+	// Codec is how records are stored, RedisWireCodec by default
+	Codec RedisCodec
+	// TtlPolicy clamps the TTLs records are cached for, nil only zeroing TTLs over
+	// 2^31-1
+	TtlPolicy *TtlPolicy
+
+	// node tells the invalidations this client publishes from those of other nodes,
+	// set on first use whichever way the client was made
+	node     string
+	nodeOnce sync.Once
+	// universal is Client, or the Cluster client
+	universal redis.UniversalClient
+
+	// flushed is what FlushCacheStats had added to the totals in redis for each cache
+	// when it last returned
+	flushMu sync.Mutex
+	flushed map[Cache]CacheStats
 }
 
 func (client *RedisClient) IsOk() bool {
-	return client.Client != nil
+	return client.Universal() != nil
 }
 
-func (client *RedisClient) InitRedis(ctx context.Context, addr string) error {
-	// 创建Redis连接
-	c := redis.NewClient(&redis.Options{
-		Addr:     addr, // Redis服务器地址
-		Password: "",   // Redis密码
-		DB:       0,    // 使用默认的数据库
-	})
-
-	// 使用Ping命令检查连接是否正常
-	pong, err := c.Ping(ctx).Result()
-	if err != nil {
-		return fmt.Errorf("connecting to Redis err:%v", err)
+// Universal returns the client of any mode, which all the cache commands go
+// through.
+func (client *RedisClient) Universal() redis.UniversalClient {
+	if client.universal != nil {
+		return client.universal
+	}
+	if client.Client != nil {
+		// set by hand
+		return client.Client
 	}
-	log.Printf("Info: Connected to Redis:%v", pong)
-
-	client.Client = c
 	return nil
 }
 
+// InitRedis connects to the single server at addr, without authentication.
+func (client *RedisClient) InitRedis(ctx context.Context, addr string) error {
+	return client.InitRedisWithOptions(ctx, &RedisOptions{UniversalOptions: redis.UniversalOptions{Addrs: []string{addr}}})
+}
+
 func (client *RedisClient) CloseRedis() {
 	if !client.IsOk() {
 		return
 	}
-	err := client.Close()
+	err := client.Universal().Close()
 	if err != nil {
 		log.Printf("Warning: closing connection err: %v\n", err)
 	}
@@ -55,7 +93,7 @@ func (client *RedisClient) setRedis(ctx context.Context, key string, value strin
 	if !client.IsOk() {
 		return fmt.Errorf("client is nil")
 	}
-	err := client.Set(ctx, key, value, expiration).Err()
+	err := client.Universal().Set(ctx, key, value, expiration).Err()
 	if err != nil {
 		return fmt.Errorf("setting key err: %v", err)
 	}
@@ -63,15 +101,15 @@ func (client *RedisClient) setRedis(ctx context.Context, key string, value strin
 }
 
 func (client *RedisClient) getRedis(ctx context.Context, key string) (string, int, error) {
-	if client.Client == nil {
+	if !client.IsOk() {
 		return "", 0, fmt.Errorf("client is nil")
 	}
-	val, err := client.Get(ctx, key).Result()
+	val, err := client.Universal().Get(ctx, key).Result()
 	if err != nil {
 		return "", 0, fmt.Errorf("getting value err: %v", err)
 	}
 
-	ttl, err := client.TTL(ctx, key).Result()
+	ttl, err := client.Universal().TTL(ctx, key).Result()
 	if err != nil {
 		return "", 0, fmt.Errorf("getting ttl err: %v", err)
 	}
@@ -80,94 +118,280 @@ func (client *RedisClient) getRedis(ctx context.Context, key string) (string, in
 }
 
 func (client *RedisClient) StoreRedisCache(ctx context.Context, q Question, answers []RR) error {
+	_, err := client.storeRedisCache(ctx, q, answers)
+	return err
+}
+
+// storeRedisCache is StoreRedisCache also reporting whether it replaced an entry.
+func (client *RedisClient) storeRedisCache(ctx context.Context, q Question, answers []RR) (bool, error) {
 	if !client.IsOk() {
-		return fmt.Errorf("client is nil")
+		return false, fmt.Errorf("client is nil")
 	}
 
-	qStr, err := json.Marshal(q)
+	key := client.cacheKey(q)
+
+	// only the records answering q may be cached under it
+	answers, _, err := scrubAnswer(q, ".", answers)
 	if err != nil {
-		return fmt.Errorf("marshaling q err: %v", err)
+		return false, fmt.Errorf("scrubbing answers err: %v", err)
 	}
 
+	recs := make([]cachedRR, 0, len(answers))
 	for _, a := range answers {
-		wo := wrappedObj{
-			Type:    a.Header().Rrtype,
-			Payload: a,
-		}
-		value, err := json.Marshal(&wo)
+		recs = append(recs, cachedRR{RR: a})
+	}
+	return client.replaceRRs(ctx, key, recs, client.TtlPolicy.CacheTtl(answers))
+}
+
+// StoreRedisNegativeCache caches resp, an NXDOMAIN or NODATA response to q, for the
+// SOA's negative TTL: the smaller of its MINIMUM and its own TTL (RFC 2308). A CNAME
+// chain leading to the missing name is cached with it.
+func (client *RedisClient) StoreRedisNegativeCache(ctx context.Context, q Question, resp *Msg) error {
+	_, err := client.storeRedisNegativeCache(ctx, q, resp)
+	return err
+}
+
+// storeRedisNegativeCache is StoreRedisNegativeCache also reporting whether it
+// replaced an entry.
+func (client *RedisClient) storeRedisNegativeCache(ctx context.Context, q Question, resp *Msg) (bool, error) {
+	if !client.IsOk() {
+		return false, fmt.Errorf("client is nil")
+	}
+
+	key := client.cacheKey(q)
+
+	answers, soa, ttl, err := negativeAnswer(q, resp)
+	if err != nil {
+		return false, err
+	}
+	if ttl == 0 {
+		// not to be cached, but not to leave what was either
+		return client.replaceRRs(ctx, key, nil, 0)
+	}
+
+	neg := *soa
+	neg.Hdr.Ttl = ttl
+	recs := make([]cachedRR, 0, len(answers)+1)
+	for _, a := range answers {
+		recs = append(recs, cachedRR{RR: a})
+	}
+	recs = append(recs, cachedRR{RR: &neg, Negative: true, Rcode: resp.Rcode})
+	// not appending to the array of answers, which may be the response's
+	rrs := append(answers[:len(answers):len(answers)], &neg)
+	return client.replaceRRs(ctx, key, recs, client.TtlPolicy.CacheTtl(rrs))
+}
+
+// replaceRRs replaces the records cached under key by recs in one transaction, so
+// readers see either the old records or the new ones but never a mix. The records
+// share one expiry, ttl from now, and are stored with ttl as their TTL, which makes
+// duplicates the same member. No recs deletes what was cached.
+func (client *RedisClient) replaceRRs(ctx context.Context, key string, recs []cachedRR, ttl uint32) (bool, error) {
+	if len(recs) == 0 {
+		n, err := client.Universal().Del(ctx, key).Result()
 		if err != nil {
-			return fmt.Errorf("marshaling value err: %v", err)
+			return false, fmt.Errorf("deleting records err: %v", err)
 		}
+		return n > 0, nil
+	}
 
-		// 当前时间戳
-		now := time.Now().Unix()
+	rrs := make([]RR, 0, len(recs))
+	for _, rec := range recs {
+		rrs = append(rrs, rec.RR)
+	}
+	rrs, err := copyRRs(rrs)
+	if err != nil {
+		return false, fmt.Errorf("copying records err: %v", err)
+	}
 
-		err = client.ZAdd(ctx, string(qStr), &redis.Z{
-			Score:  float64(now + int64(a.Header().Ttl)),
-			Member: string(value),
-		}).Err()
+	// 当前时间戳
+	now := timeNow().Unix()
+	expires := now + int64(ttl)
+
+	members := make([]*redis.Z, 0, len(recs))
+	for i, rec := range recs {
+		rec.RR = rrs[i]
+		rec.RR.Header().Ttl = ttl
+		value, err := client.Codec.encode(rec)
 		if err != nil {
-			return fmt.Errorf("ZAdd err: %v", err)
+			return false, err
 		}
+		members = append(members, &redis.Z{Score: float64(expires), Member: value})
 	}
 
-	return nil
+	// redis drops the key once the records are too old even to be served stale
+	var del *redis.IntCmd
+	_, err = client.Universal().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(ctx, key)
+		pipe.ZAdd(ctx, key, members...)
+		pipe.Expire(ctx, key, time.Duration(ttl)*time.Second+client.StaleWindow)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("replacing records err: %v", err)
+	}
+	atomic.AddUint64(&client.stats.stores, 1)
+	return del.Val() > 0, nil
 }
 
+// GetRedisCacheByKey returns the positive records cached for q.
 func (client *RedisClient) GetRedisCacheByKey(ctx context.Context, q Question) ([]RR, error) {
-	if !client.IsOk() {
-		return nil, fmt.Errorf("client is nil")
+	entry, err := client.lookupRedisCache(ctx, q, false)
+	if entry == nil {
+		return nil, err
+	}
+	return entry.Msg.Answer, err
+}
+
+// GetRedisCacheMsg returns the response cached for q, nil if there is none. A
+// negative response has the rcode NXDOMAIN or, for NODATA, success with no answer,
+// and its SOA in Ns.
+func (client *RedisClient) GetRedisCacheMsg(ctx context.Context, q Question) (*Msg, error) {
+	entry, err := client.lookupRedisCache(ctx, q, false)
+	if entry == nil {
+		return nil, err
+	}
+	return entry.Msg, nil
+}
+
+// GetRedisStaleMsg is GetRedisCacheMsg also returning records expired less than
+// StaleWindow ago, with their TTL set to StaleTtl.
+func (client *RedisClient) GetRedisStaleMsg(ctx context.Context, q Question) (*Msg, error) {
+	entry, err := client.lookupRedisCache(ctx, q, true)
+	if entry == nil {
+		return nil, err
+	}
+	return entry.Msg, nil
+}
+
+// GetRedisCacheEntry is GetRedisCacheMsg counting the hit and returning the TTLs
+// and hits prefetching decides on, nil if nothing is cached.
+func (client *RedisClient) GetRedisCacheEntry(ctx context.Context, q Question) (*CacheEntry, error) {
+	entry, err := client.lookupRedisCache(ctx, q, false)
+	if entry == nil {
+		return nil, err
 	}
 
-	qStr, err := json.Marshal(q)
+	// the count lives as long as the entry would without being refreshed
+	key := entry.key + hitsKeySuffix
+	var incr *redis.IntCmd
+	_, err = client.Universal().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, time.Duration(entry.OrigTtl)*time.Second+client.StaleWindow)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("marshaling q err: %v", err)
+		return nil, fmt.Errorf("counting hit err: %v", err)
+	}
+	entry.Hits = incr.Val()
+	return &entry.CacheEntry, nil
+}
+
+// redisEntry is a CacheEntry with the key it was read from.
+type redisEntry struct {
+	CacheEntry
+	key string
+	// stale is set when expired records were kept
+	stale bool
+}
+
+// lookupRedisCache is getRedisCache counting the lookup in the stats.
+func (client *RedisClient) lookupRedisCache(ctx context.Context, q Question, stale bool) (*redisEntry, error) {
+	entry, err := client.getRedisCache(ctx, q, stale)
+	if err != nil {
+		return entry, err
+	}
+
+	if !stale {
+		var m *Msg
+		if entry != nil {
+			m = entry.Msg
+		}
+		client.stats.lookup(q, m)
+	} else if entry != nil && entry.stale {
+		atomic.AddUint64(&client.stats.staleHits, 1)
+	}
+	return entry, nil
+}
+
+// has reports whether records are cached for q, stale or not, without counting a
+// lookup.
+func (client *RedisClient) has(ctx context.Context, q Question) (bool, error) {
+	entry, err := client.getRedisCache(ctx, q, true)
+	return entry != nil, err
+}
+
+// getRedisCache returns the unexpired records cached for q, or also the stale ones,
+// nil if there are none.
+func (client *RedisClient) getRedisCache(ctx context.Context, q Question, stale bool) (*redisEntry, error) {
+	if !client.IsOk() {
+		return nil, fmt.Errorf("client is nil")
 	}
 
+	key := client.cacheKey(q)
+
 	// 当前时间戳
-	now := time.Now().Unix()
+	now := timeNow().Unix()
+	min := now
+	if stale {
+		min -= int64(client.StaleWindow / time.Second)
+	}
 
-	zList, err := client.ZRangeByScoreWithScores(ctx, string(qStr), &redis.ZRangeBy{
-		Min: fmt.Sprintf("%d", now),
+	zList, err := client.Universal().ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min: fmt.Sprintf("%d", min),
 		Max: "+inf",
 	}).Result()
 	if err != nil {
 		return nil, fmt.Errorf("ZRangeByScoreWithScores err: %v", err)
 
 	}
+	if len(zList) == 0 {
+		return nil, nil
+	}
 
-	var answers []RR
-	for _, z := range zList {
-		var wo wrappedObj
+	m := &Msg{MsgHdr: MsgHdr{Response: true}, Question: []Question{q}}
+	entry := &redisEntry{CacheEntry: CacheEntry{Msg: m}, key: key}
+	for i, z := range zList {
 		zm, ok := z.Member.(string)
 		if !ok {
 			return nil, fmt.Errorf("unable to convert zm: %v", z.Member)
 		}
-		err = json.Unmarshal([]byte(zm), &wo)
+		rec, err := decodeCachedRR(zm)
 		if err != nil {
-			return nil, fmt.Errorf("unmarshaling z.member err: %v", err)
+			atomic.AddUint64(&client.stats.decodeErrors, 1)
+			return nil, err
 		}
+		rr := rec.RR
 
-		if rrFunc, ok := TypeToRR[wo.Type]; ok {
-			payloadStr, err := json.Marshal(wo.Payload)
-			if err != nil {
-				return nil, fmt.Errorf("marshaling payload err: %v", err)
-			}
-			rr := rrFunc()
-			err = json.Unmarshal(payloadStr, &rr)
-			if err != nil {
-				return nil, fmt.Errorf("unmarshaling payload err: %v", err)
-			}
+		origTtl := rr.Header().Ttl
+		ttl := remainingTtl(z.Score, now)
+		if ttl == 0 && stale {
+			rr.Header().Ttl = client.staleTtl()
+			entry.stale = true
+		} else {
+			rr.Header().Ttl = client.TtlPolicy.ceiling(rr, ttl)
+		}
 
-			rr.Header().Ttl = uint32(z.Score - float64(now))
+		if i == 0 || origTtl < entry.OrigTtl {
+			entry.OrigTtl = origTtl
+		}
+		if i == 0 || rr.Header().Ttl < entry.Ttl {
+			entry.Ttl = rr.Header().Ttl
+		}
 
-			answers = append(answers, rr)
+		if rec.Negative {
+			m.Rcode = rec.Rcode
+			m.Ns = []RR{rr}
 		} else {
-			return nil, fmt.Errorf("unsupported rr type %d", wo.Type)
+			m.Answer = append(m.Answer, rr)
 		}
 	}
 
-	return answers, nil
+	// members sharing an expiry come in byte order, put the CNAME chain back in order
+	if chain, _, err := scrubAnswer(q, ".", m.Answer); err == nil && len(chain) == len(m.Answer) {
+		m.Answer = chain
+	}
+
+	return entry, nil
 }
 
 func (client *RedisClient) GetRedisCacheAllData(ctx context.Context) (map[Question][]RR, error) {
@@ -175,62 +399,262 @@ func (client *RedisClient) GetRedisCacheAllData(ctx context.Context) (map[Questi
 		return nil, fmt.Errorf("client is nil")
 	}
 
-	keyList, err := client.Keys(ctx, "*").Result()
-	if err != nil {
-		return nil, fmt.Errorf("client.GetRedis err: %v", err)
-	}
-
 	res := make(map[Question][]RR)
 
-	for _, key := range keyList {
-		var q Question
-		err = json.Unmarshal([]byte(key), &q)
+	err := client.scanQuestions(ctx, func(key string, q Question) error {
+		// reading everything is no lookup to count
+		entry, err := client.getRedisCache(ctx, q, false)
 		if err != nil {
-			return nil, fmt.Errorf("unmarshaling key err: %v", err)
+			return fmt.Errorf("getRedisCache err: %v", err)
 		}
 
-		rrs, err := client.GetRedisCacheByKey(ctx, q)
-		if err != nil {
-			return nil, fmt.Errorf("GetRedisCacheByKey err: %v", err)
+		var rrs []RR
+		if entry != nil {
+			rrs = entry.Msg.Answer
 		}
-
 		res[q] = rrs
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return res, nil
 }
 
-func (client *RedisClient) CronRefreshData(ctx context.Context) {
+// Store implements Cache with StoreRedisCache.
+func (client *RedisClient) Store(ctx context.Context, q Question, answers []RR) error {
+	return client.StoreRedisCache(ctx, q, answers)
+}
+
+// StoreNegative implements Cache with StoreRedisNegativeCache.
+func (client *RedisClient) StoreNegative(ctx context.Context, q Question, resp *Msg) error {
+	return client.StoreRedisNegativeCache(ctx, q, resp)
+}
+
+// Lookup implements Cache with GetRedisCacheEntry.
+func (client *RedisClient) Lookup(ctx context.Context, q Question) (*CacheEntry, error) {
+	return client.GetRedisCacheEntry(ctx, q)
+}
+
+// LookupStale implements Cache with GetRedisStaleMsg.
+func (client *RedisClient) LookupStale(ctx context.Context, q Question) (*Msg, error) {
+	return client.GetRedisStaleMsg(ctx, q)
+}
+
+func (client *RedisClient) Delete(ctx context.Context, q Question) error {
 	if !client.IsOk() {
-		return
+		return fmt.Errorf("client is nil")
 	}
 
-	var err error
+	return client.deleteEntry(ctx, client.cacheKey(q))
+}
 
-	for {
-		var cursor uint64
+// deleteEntry deletes key and the count of its hits, one at a time as they may be
+// in different Cluster slots.
+func (client *RedisClient) deleteEntry(ctx context.Context, key string) error {
+	_, err := client.Universal().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.Del(ctx, key+hitsKeySuffix)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("deleting key err: %v", err)
+	}
+	return nil
+}
+
+func (client *RedisClient) Purge(ctx context.Context, inv Invalidation) error {
+	if inv.Kind == InvalidateQuestion {
+		return client.Delete(ctx, inv.Question)
+	}
+	if !client.IsOk() {
+		return fmt.Errorf("client is nil")
+	}
+
+	return client.scanQuestions(ctx, func(key string, q Question) error {
+		if !inv.Matches(q) {
+			return nil
+		}
+		return client.deleteEntry(ctx, key)
+	})
+}
+
+// Stats implements Cache with what the client counted, see FleetStats for what
+// every node sharing its redis did.
+func (client *RedisClient) Stats() CacheStats {
+	return client.stats.snapshot()
+}
+
+func (client *RedisClient) Iterate(ctx context.Context, fn func(q Question, m *Msg) bool) error {
+	if !client.IsOk() {
+		return fmt.Errorf("client is nil")
+	}
+
+	err := client.scanQuestions(ctx, func(key string, q Question) error {
+		entry, err := client.getRedisCache(ctx, q, false)
+		if err != nil {
+			return err
+		}
+		if entry != nil && !fn(q, entry.Msg) {
+			return errStopScan
+		}
+		return nil
+	})
+	if err == errStopScan {
+		return nil
+	}
+	return err
+}
+
+// errStopScan ends scanQuestions early.
+var errStopScan = errors.New("scan stopped")
+
+// scanQuestions calls fn with the key of every cached question under KeyPrefix,
+// until it returns an error.
+func (client *RedisClient) scanQuestions(ctx context.Context, fn func(key string, q Question) error) error {
+	return client.scanKeys(ctx, client.keyPrefix()+"*", func(key string) error {
+		q, ok := client.parseCacheKey(key)
+		if !ok {
+			// hit counts
+			return nil
+		}
+		return fn(key, q)
+	})
+}
 
+// scanKeys calls fn with the keys matching match on every shard, until fn returns an
+// error.
+func (client *RedisClient) scanKeys(ctx context.Context, match string, fn func(key string) error) error {
+	shards, err := client.shards(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		var cursor uint64
 		for {
-			var keys []string
-			keys, cursor, err = client.Scan(ctx, cursor, "*", 10).Result()
+			keys, next, err := shard.Scan(ctx, cursor, match, 100).Result()
 			if err != nil {
-				log.Printf("CronRefreshData Scan err: %v", err)
+				return fmt.Errorf("scanning keys err: %v", err)
 			}
 
-			// 当前时间戳
-			now := time.Now().Unix()
 			for _, key := range keys {
-				_, err = client.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprintf("%d", now)).Result()
+				err = fn(key)
 				if err != nil {
-					log.Printf("CronRefreshData ZRemRangeByScore err: %v", err)
+					return err
 				}
 			}
 
+			cursor = next
 			if cursor == 0 {
 				break
 			}
 		}
+	}
+	return nil
+}
+
+// MigrateRedisKeys moves the entries cached under the JSON of their question, as
+// they used to be, to their keys under KeyPrefix, merging them with any entry
+// already there. It returns how many it moved. The old and new keys of an entry
+// may be on different Cluster nodes, so it is for a single server or Sentinel
+// master, which is all the old keys were written to.
+func (client *RedisClient) MigrateRedisKeys(ctx context.Context) (int, error) {
+	if !client.IsOk() {
+		return 0, fmt.Errorf("client is nil")
+	}
+
+	moved := 0
+	err := client.scanKeys(ctx, "{*", func(old string) error {
+		var q Question
+		err := json.Unmarshal([]byte(old), &q)
+		if err != nil || q.Name == "" {
+			// not ours
+			return nil
+		}
+
+		key := client.cacheKey(q)
+		_, err = client.Universal().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZUnionStore(ctx, key, &redis.ZStore{Keys: []string{key, old}, Aggregate: "MAX"})
+			pipe.Del(ctx, old, "hits:"+old)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("moving %s err: %v", old, err)
+		}
+		err = client.expireWithLast(ctx, key)
+		if err != nil {
+			return err
+		}
+		moved++
+		return nil
+	})
+	return moved, err
+}
+
+// expireWithLast sets the TTL of key to when its last record is too old to be
+// served stale.
+func (client *RedisClient) expireWithLast(ctx context.Context, key string) error {
+	last, err := client.Universal().ZRangeWithScores(ctx, key, -1, -1).Result()
+	if err != nil {
+		return fmt.Errorf("getting last record err: %v", err)
+	}
+	if len(last) == 0 {
+		return nil
+	}
+	expires := time.Unix(int64(last[0].Score), 0).Add(client.StaleWindow)
+	err = client.Universal().Expire(ctx, key, expires.Sub(timeNow())).Err()
+	if err != nil {
+		return fmt.Errorf("setting ttl err: %v", err)
+	}
+	return nil
+}
+
+func (client *RedisClient) keyPrefix() string {
+	if client.KeyPrefix != "" {
+		return client.KeyPrefix
+	}
+	return defaultKeyPrefix
+}
+
+// cacheKey returns the key q is cached under.
+func (client *RedisClient) cacheKey(q Question) string {
+	return fmt.Sprintf("%s%s|%d|%d", client.keyPrefix(), CanonicalName(q.Name), q.QType, q.QClass)
+}
+
+// parseCacheKey returns the question cached under key, false if key is no such key.
+func (client *RedisClient) parseCacheKey(key string) (Question, bool) {
+	if !strings.HasPrefix(key, client.keyPrefix()) {
+		return Question{}, false
+	}
+	key = key[len(client.keyPrefix()):]
+
+	i := strings.LastIndexByte(key, '|')
+	if i < 0 {
+		return Question{}, false
+	}
+	class, err := strconv.ParseUint(key[i+1:], 10, 16)
+	if err != nil {
+		return Question{}, false
+	}
+	key = key[:i]
+
+	i = strings.LastIndexByte(key, '|')
+	if i < 0 {
+		return Question{}, false
+	}
+	qtype, err := strconv.ParseUint(key[i+1:], 10, 16)
+	if err != nil {
+		return Question{}, false
+	}
+
+	return Question{Name: key[:i], QType: uint16(qtype), QClass: uint16(class)}, true
+}
 
-		time.Sleep(1 * time.Second)
+func (client *RedisClient) staleTtl() uint32 {
+	if client.StaleTtl > 0 {
+		return client.StaleTtl
 	}
+	return defaultStaleTtl
 }
@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RedisCodec is how the records of cached entries are encoded in redis. Records
+// in either encoding are read whatever the codec.
+type RedisCodec int
+
+const (
+	// RedisWireCodec encodes a record in DNS wire format behind a version byte
+	RedisWireCodec RedisCodec = iota
+	// RedisJSONCodec encodes a record as JSON, to read it when debugging
+	RedisJSONCodec
+)
+
+const (
+	// redisWireVersion starts records in wire format, which JSON starts with '{'
+	redisWireVersion = 1
+	// redisWireNegative flags the SOA of a negative answer
+	redisWireNegative = 1 << 0
+)
+
+// cachedRR is a record as cached, with the TTL it was stored with.
+type cachedRR struct {
+	RR RR
+	// Negative marks the SOA of a negative answer, Rcode telling NXDOMAIN from NODATA
+	Negative bool
+	Rcode    int
+}
+
+type wrappedObj struct {
+	Type    uint16
+	Payload json.RawMessage
+	// Negative marks the SOA of a cached negative answer, Rcode telling NXDOMAIN
+	// from NODATA
+	Negative bool `json:",omitempty"`
+	Rcode    int  `json:",omitempty"`
+	// OrigTtl is the TTL the record was cached with
+	OrigTtl uint32 `json:",omitempty"`
+}
+
+// encode returns rec as a redis value:
+//   - wire: version, flags, rcode and the packed record, each a byte but the last;
+//   - JSON: a wrappedObj.
+func (c RedisCodec) encode(rec cachedRR) (string, error) {
+	if c == RedisJSONCodec {
+		payload, err := json.Marshal(rec.RR)
+		if err != nil {
+			return "", fmt.Errorf("marshaling payload err: %v", err)
+		}
+		value, err := json.Marshal(&wrappedObj{
+			Type:     rec.RR.Header().Rrtype,
+			Payload:  payload,
+			Negative: rec.Negative,
+			Rcode:    rec.Rcode,
+			OrigTtl:  rec.RR.Header().Ttl,
+		})
+		if err != nil {
+			return "", fmt.Errorf("marshaling value err: %v", err)
+		}
+		return string(value), nil
+	}
+
+	data, err := packRRs([]RR{rec.RR})
+	if err != nil {
+		return "", fmt.Errorf("packing value err: %v", err)
+	}
+	var flags byte
+	if rec.Negative {
+		flags |= redisWireNegative
+	}
+	return string(append([]byte{redisWireVersion, flags, byte(rec.Rcode)}, data...)), nil
+}
+
+// decodeCachedRR returns the record encoded in value by any codec.
+func decodeCachedRR(value string) (cachedRR, error) {
+	if len(value) > 0 && value[0] == '{' {
+		var wo wrappedObj
+		err := json.Unmarshal([]byte(value), &wo)
+		if err != nil {
+			return cachedRR{}, fmt.Errorf("unmarshaling value err: %v", err)
+		}
+		rr := newRR(wo.Type)
+		err = json.Unmarshal(wo.Payload, rr)
+		if err != nil {
+			return cachedRR{}, fmt.Errorf("unmarshaling payload err: %v", err)
+		}
+		// records stored before it was kept have their own TTL
+		if wo.OrigTtl > 0 {
+			rr.Header().Ttl = wo.OrigTtl
+		}
+		return cachedRR{RR: rr, Negative: wo.Negative, Rcode: wo.Rcode}, nil
+	}
+
+	if len(value) < 3 || value[0] != redisWireVersion {
+		return cachedRR{}, fmt.Errorf("unknown value encoding")
+	}
+	rrs, _, err := unpackRRSlice([]byte(value[3:]), 0, 1)
+	if err != nil {
+		return cachedRR{}, fmt.Errorf("unpacking value err: %v", err)
+	}
+	return cachedRR{RR: rrs[0], Negative: value[1]&redisWireNegative != 0, Rcode: int(value[2])}, nil
+}
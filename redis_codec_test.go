@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRedisCodecsRoundTrip(t *testing.T) {
+	q := Question{Name: "www.example.com.", QType: 65280, QClass: ClassINET}
+	unknown := &RFC3597{Hdr: RR_Header{Name: q.Name, Rrtype: q.QType, Class: ClassINET, Ttl: 300}, Rdata: []byte{1, 2, 3}}
+
+	for _, codec := range []RedisCodec{RedisWireCodec, RedisJSONCodec} {
+		client := startTestRedis(t)
+		client.Codec = codec
+		ctx := context.Background()
+		setTestTime(t, time.Unix(1700000000, 0))
+
+		err := client.StoreRedisCache(ctx, q, []RR{unknown})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := client.GetRedisCacheEntry(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entry.Msg.Answer) != 1 {
+			t.Fatalf("codec %d: answer = %v", codec, entry.Msg.Answer)
+		}
+		rr, ok := entry.Msg.Answer[0].(*RFC3597)
+		if !ok || string(rr.Rdata) != string(unknown.Rdata) || entry.OrigTtl != 300 {
+			t.Errorf("codec %d: decoded %v with orig ttl %d", codec, entry.Msg.Answer[0], entry.OrigTtl)
+		}
+	}
+}
+
+func TestRedisCodecNegative(t *testing.T) {
+	q := Question{Name: "nothere.example.com.", QType: TypeA, QClass: ClassINET}
+	resp := testNegativeResponse(q, RcodeNameError, 3600, 300)
+
+	for _, codec := range []RedisCodec{RedisWireCodec, RedisJSONCodec} {
+		client := startTestRedis(t)
+		client.Codec = codec
+		ctx := context.Background()
+		setTestTime(t, time.Unix(1700000000, 0))
+
+		err := client.StoreRedisNegativeCache(ctx, q, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := client.GetRedisCacheEntry(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Msg.Rcode != RcodeNameError || len(entry.Msg.Ns) != 1 || entry.OrigTtl != 300 {
+			t.Errorf("codec %d: rcode=%d ns=%v orig ttl=%d", codec, entry.Msg.Rcode, entry.Msg.Ns, entry.OrigTtl)
+		}
+	}
+}
+
+func benchmarkRecord() cachedRR {
+	return cachedRR{RR: testRR("www.example.com.", TypeA, "192.0.2.10")}
+}
+
+func BenchmarkRedisWireEncode(b *testing.B) {
+	rec := benchmarkRecord()
+	for i := 0; i < b.N; i++ {
+		RedisWireCodec.encode(rec)
+	}
+}
+
+func BenchmarkRedisJSONEncode(b *testing.B) {
+	rec := benchmarkRecord()
+	for i := 0; i < b.N; i++ {
+		RedisJSONCodec.encode(rec)
+	}
+}
+
+func BenchmarkRedisWireDecode(b *testing.B) {
+	value, _ := RedisWireCodec.encode(benchmarkRecord())
+	for i := 0; i < b.N; i++ {
+		decodeCachedRR(value)
+	}
+}
+
+func BenchmarkRedisJSONDecode(b *testing.B) {
+	value, _ := RedisJSONCodec.encode(benchmarkRecord())
+	for i := 0; i < b.N; i++ {
+		decodeCachedRR(value)
+	}
+}
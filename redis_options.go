@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RedisOptions tell InitRedisWithOptions how to connect: to the Sentinels of
+// MasterName if set, to a Cluster if Cluster is set or Addrs has more than one
+// address, else to the single server at Addrs[0].
+type RedisOptions struct {
+	redis.UniversalOptions
+	// Cluster makes a Cluster client even from a single seed address
+	Cluster bool
+}
+
+// InitRedisWithOptions connects with opts, checking the connection with a PING.
+func (client *RedisClient) InitRedisWithOptions(ctx context.Context, opts *RedisOptions) error {
+	var c redis.UniversalClient
+	if opts.Cluster && opts.MasterName == "" {
+		c = redis.NewClusterClient(opts.UniversalOptions.Cluster())
+	} else {
+		c = redis.NewUniversalClient(&opts.UniversalOptions)
+	}
+
+	// 使用Ping命令检查连接是否正常
+	pong, err := c.Ping(ctx).Result()
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("connecting to Redis err:%v", err)
+	}
+	log.Printf("Info: Connected to Redis:%v", pong)
+
+	client.universal = c
+	client.Client, _ = c.(*redis.Client)
+	return nil
+}
+
+// InitRedisURL connects with the options of ParseRedisURL.
+func (client *RedisClient) InitRedisURL(ctx context.Context, rawURL string) error {
+	opts, err := ParseRedisURL(rawURL)
+	if err != nil {
+		return err
+	}
+	return client.InitRedisWithOptions(ctx, opts)
+}
+
+// ParseRedisURL returns the options of a URL of the forms
+//   - redis://[user:password@]host:port[/db][?options], rediss:// for TLS, as
+//     redis.ParseURL takes;
+//   - redis+sentinel://[user:password@]host:port[,host:port...]/master[/db], the
+//     password also authenticating with the Sentinels unless the sentinel_password
+//     option is given;
+//   - redis+cluster://[user:password@]host:port[,host:port...], the seed nodes.
+//
+// The +sentinel and +cluster schemes take TLS as rediss+sentinel and rediss+cluster.
+func ParseRedisURL(rawURL string) (*RedisOptions, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis url err: %v", err)
+	}
+
+	scheme, kind, _ := strings.Cut(u.Scheme, "+")
+	if kind == "" {
+		o, err := redis.ParseURL(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing redis url err: %v", err)
+		}
+		return &RedisOptions{UniversalOptions: redis.UniversalOptions{
+			Addrs:        []string{o.Addr},
+			DB:           o.DB,
+			Username:     o.Username,
+			Password:     o.Password,
+			MaxRetries:   o.MaxRetries,
+			DialTimeout:  o.DialTimeout,
+			ReadTimeout:  o.ReadTimeout,
+			WriteTimeout: o.WriteTimeout,
+			PoolFIFO:     o.PoolFIFO,
+			PoolSize:     o.PoolSize,
+			MinIdleConns: o.MinIdleConns,
+			MaxConnAge:   o.MaxConnAge,
+			PoolTimeout:  o.PoolTimeout,
+			IdleTimeout:  o.IdleTimeout,
+			TLSConfig:    o.TLSConfig,
+		}}, nil
+	}
+
+	opts := &RedisOptions{}
+	switch scheme {
+	case "redis":
+	case "rediss":
+		opts.TLSConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("unknown redis url scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no redis address in url")
+	}
+	opts.Addrs = strings.Split(u.Host, ",")
+	if opts.TLSConfig != nil {
+		// the addresses share one name to check, the first's
+		host, _, _ := strings.Cut(opts.Addrs[0], ":")
+		opts.TLSConfig.ServerName = host
+	}
+	opts.Username = u.User.Username()
+	opts.Password, _ = u.User.Password()
+
+	path := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch kind {
+	case "sentinel":
+		if path[0] == "" {
+			return nil, fmt.Errorf("no sentinel master name in url")
+		}
+		opts.MasterName = path[0]
+		if len(path) > 1 {
+			opts.DB, err = strconv.Atoi(path[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid redis db %q", path[1])
+			}
+		}
+		opts.SentinelPassword = opts.Password
+		if u.Query().Has("sentinel_password") {
+			opts.SentinelPassword = u.Query().Get("sentinel_password")
+		}
+	case "cluster":
+		if path[0] != "" {
+			return nil, fmt.Errorf("a redis cluster has no db")
+		}
+		opts.Cluster = true
+	default:
+		return nil, fmt.Errorf("unknown redis url scheme %q", u.Scheme)
+	}
+	return opts, nil
+}
+
+// shards returns the clients of the servers each holding a part of the keyspace:
+// the masters of a Cluster, else the one server.
+func (client *RedisClient) shards(ctx context.Context) ([]redis.Cmdable, error) {
+	cluster, ok := client.Universal().(*redis.ClusterClient)
+	if !ok {
+		return []redis.Cmdable{client.Universal()}, nil
+	}
+
+	var mu sync.Mutex
+	var shards []redis.Cmdable
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		shards = append(shards, c)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing cluster masters err: %v", err)
+	}
+	return shards, nil
+}
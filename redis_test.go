@@ -0,0 +1,240 @@
+package dns
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"testing"
+	"time"
+)
+
+// startTestRedis returns a RedisClient connected to an in-memory redis.
+func startTestRedis(t *testing.T) *RedisClient {
+	mr := miniredis.RunT(t)
+	client := &RedisClient{}
+	err := client.InitRedis(context.Background(), mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.CloseRedis)
+	return client
+}
+
+// setTestTime makes the cache see now as the current time until the test ends.
+func setTestTime(t *testing.T, now time.Time) {
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() {
+		timeNow = time.Now
+	})
+}
+
+func testNegativeResponse(q Question, rcode int, soaTtl, minTtl uint32) *Msg {
+	soa := testRR("example.com.", TypeSOA, "").(*SOA)
+	soa.Hdr.Ttl = soaTtl
+	soa.MinTtl = minTtl
+	m := &Msg{MsgHdr: MsgHdr{Response: true, Rcode: rcode}, Question: []Question{q}}
+	m.Ns = []RR{soa}
+	return m
+}
+
+func TestRedisNegativeCache(t *testing.T) {
+	client := startTestRedis(t)
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	nx := Question{Name: "nothere.example.com.", QType: TypeA, QClass: ClassINET}
+	nodata := Question{Name: "www.example.com.", QType: TypeAAAA, QClass: ClassINET}
+	err := client.StoreRedisNegativeCache(ctx, nx, testNegativeResponse(nx, RcodeNameError, 3600, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.StoreRedisNegativeCache(ctx, nodata, testNegativeResponse(nodata, RcodeSuccess, 60, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := client.GetRedisCacheMsg(ctx, nx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil || m.Rcode != RcodeNameError || len(m.Answer) != 0 || len(m.Ns) != 1 {
+		t.Fatalf("nxdomain cached as %+v", m)
+	}
+	// the MINIMUM is below the SOA TTL
+	if ttl := m.Ns[0].Header().Ttl; ttl != 300 {
+		t.Errorf("nxdomain ttl = %d, want 300", ttl)
+	}
+
+	m, err = client.GetRedisCacheMsg(ctx, nodata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil || m.Rcode != RcodeSuccess || len(m.Answer) != 0 || len(m.Ns) != 1 {
+		t.Fatalf("nodata cached as %+v", m)
+	}
+	// the SOA TTL is below the MINIMUM
+	if ttl := m.Ns[0].Header().Ttl; ttl != 60 {
+		t.Errorf("nodata ttl = %d, want 60", ttl)
+	}
+
+	setTestTime(t, now.Add(2*time.Minute))
+	m, err = client.GetRedisCacheMsg(ctx, nodata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != nil {
+		t.Errorf("expired nodata still cached: %+v", m)
+	}
+}
+
+func TestRedisNegativeCacheRejectsPositive(t *testing.T) {
+	client := startTestRedis(t)
+	q := Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET}
+	resp := testNegativeResponse(q, RcodeSuccess, 3600, 300)
+	resp.Answer = []RR{testRR("www.example.com.", TypeA, "192.0.2.1")}
+
+	err := client.StoreRedisNegativeCache(context.Background(), q, resp)
+	if err == nil {
+		t.Error("positive answer cached as negative")
+	}
+}
+
+func TestRedisReplacesRRset(t *testing.T) {
+	client := startTestRedis(t)
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	q := Question{Name: "www.other.net.", QType: TypeA, QClass: ClassINET}
+	cname := testRR("www.other.net.", TypeCNAME, "www.example.com.")
+	old := testRR("www.example.com.", TypeA, "192.0.2.1")
+	err := client.StoreRedisCache(ctx, q, []RR{cname, old})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same record twice with other TTLs, and the old address gone
+	a := testRR("www.example.com.", TypeA, "192.0.2.2")
+	dup := testRR("www.example.com.", TypeA, "192.0.2.2")
+	dup.Header().Ttl = 60
+	err = client.StoreRedisCache(ctx, q, []RR{cname, a, dup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Header().Ttl != 3600 {
+		t.Error("storing changed the caller's records")
+	}
+
+	n, err := client.ZCard(ctx, client.cacheKey(q)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d members cached, want the cname and one address", n)
+	}
+	rrs, err := client.GetRedisCacheByKey(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 2 || rrs[0].Header().Rrtype != TypeCNAME || rrs[1].(*A).A.String() != "192.0.2.2" {
+		t.Fatalf("cached = %v, want the chain to the new address", rrs)
+	}
+	for _, rr := range rrs {
+		if rr.Header().Ttl != 60 {
+			t.Errorf("%v does not share the smallest TTL", rr)
+		}
+	}
+}
+
+func TestRedisStoreEmptyRRsetDeletes(t *testing.T) {
+	client := startTestRedis(t)
+	ctx := context.Background()
+
+	q := testStoreA(t, client, "www.example.com.", 600)
+	// nothing answering q is left once scrubbed
+	err := client.StoreRedisCache(ctx, q, []RR{testRR("other.example.com.", TypeA, "192.0.2.2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs, err := client.GetRedisCacheByKey(ctx, q)
+	if err != nil || len(rrs) != 0 {
+		t.Errorf("old rrset still cached: %v, %v", rrs, err)
+	}
+}
+
+func TestRedisKeySchema(t *testing.T) {
+	client := startTestRedis(t)
+	client.KeyPrefix = "test:"
+	ctx := context.Background()
+
+	err := client.Set(ctx, "unrelated", "kept", 0).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := Question{Name: "WWW.Example.com", QType: TypeA, QClass: ClassINET}
+	err = client.StoreRedisCache(ctx, q, []RR{testRR("www.example.com.", TypeA, "192.0.2.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := client.Keys(ctx, "test:*").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "test:www.example.com.|1|1" {
+		t.Errorf("keys = %v", keys)
+	}
+
+	// names differing in case are one entry
+	rrs, err := client.GetRedisCacheByKey(ctx, Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET})
+	if err != nil || len(rrs) != 1 {
+		t.Errorf("lookup = %v, %v", rrs, err)
+	}
+
+	all, err := client.GetRedisCacheAllData(ctx)
+	if err != nil || len(all) != 1 {
+		t.Errorf("all = %v, %v", all, err)
+	}
+	err = client.Purge(ctx, invalidateAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := client.Get(ctx, "unrelated").Result(); v != "kept" {
+		t.Error("purge touched a key outside the prefix")
+	}
+}
+
+func TestMigrateRedisKeys(t *testing.T) {
+	client := startTestRedis(t)
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	// an entry as it used to be stored
+	q := Question{Name: "baidu.com", QType: TypeA, QClass: ClassINET}
+	old := `{"Name":"baidu.com","QType":1,"QClass":1}`
+	member := `{"Type":1,"Payload":{"Hdr":{"Name":"baidu.com.","Rrtype":1,"Class":1,"Ttl":60,"Rdlength":4},"A":"39.156.66.10"}}`
+	err := client.ZAdd(ctx, old, &redis.Z{Score: float64(now.Unix() + 60), Member: member}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := client.MigrateRedisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 {
+		t.Errorf("moved %d keys, want 1", moved)
+	}
+	if n, _ := client.Exists(ctx, old).Result(); n != 0 {
+		t.Error("old key kept")
+	}
+	rrs, err := client.GetRedisCacheByKey(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || rrs[0].(*A).A.String() != "39.156.66.10" || rrs[0].Header().Ttl != 60 {
+		t.Errorf("migrated entry = %v", rrs)
+	}
+}
@@ -0,0 +1,488 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RootHints are the IPv4 addresses of the root servers a-m.
+var RootHints = []string{
+	"198.41.0.4:53",
+	"170.247.170.2:53",
+	"192.33.4.12:53",
+	"199.7.91.13:53",
+	"192.203.230.10:53",
+	"192.5.5.241:53",
+	"192.112.36.4:53",
+	"198.97.190.53:53",
+	"192.36.148.17:53",
+	"192.58.128.30:53",
+	"193.0.14.129:53",
+	"199.7.83.42:53",
+	"202.12.27.33:53",
+}
+
+const (
+	defaultMaxReferrals = 20
+	defaultMaxCNAMEs    = 8
+	defaultMaxDepth     = 4
+	defaultMaxMinimise  = 10
+	// defaultResolveTimeout bounds answering a query in ServeDNS, long after a
+	// client has given up
+	defaultResolveTimeout = 10 * time.Second
+)
+
+// Resolver resolves names iteratively, following referrals from the root hints
+// down to the authoritative servers.
+type Resolver struct {
+	// QNAME minimisation counters, first for the alignment atomic needs
+	minimised uint64
+	fallbacks uint64
+
+	// RootHints are the "ip:port" addresses resolution starts from, RootHints by default
+	RootHints []string
+	// Port is used for name server addresses learnt from referrals, "53" by default
+	Port string
+	// Client sends the queries, a Client with RandomPort if nil
+	Client *Client
+	// Use0x20 randomizes the case of query names and drops responses not echoing
+	// it, so spoofing a response also means guessing the case
+	Use0x20 bool
+	// MinimiseQNAME only tells the servers of each zone the name down to one label
+	// below it (RFC 9156), asking for an A record, and falls back to the full name
+	// when they answer such queries badly
+	MinimiseQNAME bool
+	// MaxMinimise bounds the labels added one at a time before the full name is asked
+	MaxMinimise int
+	// MaxReferrals bounds the referrals followed for one name
+	MaxReferrals int
+	// MaxCNAMEs bounds the length of a CNAME chain
+	MaxCNAMEs int
+	// MaxDepth bounds nested resolutions of name server names without glue
+	MaxDepth int
+	// Timeout bounds resolving a query in ServeDNS, 10s by default
+	Timeout time.Duration
+}
+
+// MinimiseStats counts the queries sent with a minimised name and how many of them
+// had to be retried with the full name.
+type MinimiseStats struct {
+	Minimised uint64
+	Fallbacks uint64
+}
+
+func (res *Resolver) MinimiseStats() MinimiseStats {
+	return MinimiseStats{
+		Minimised: atomic.LoadUint64(&res.minimised),
+		Fallbacks: atomic.LoadUint64(&res.fallbacks),
+	}
+}
+
+func (res *Resolver) ServeDNS(w ResponseWriter, r *Msg) {
+	m := new(Msg).SetReply(r)
+	m.RecursionAvailable = true
+
+	if len(r.Question) != 1 {
+		m.Rcode = RcodeFormatError
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout(res.Timeout))
+		resp, err := res.Resolve(ctx, r.Question[0])
+		cancel()
+		if err != nil {
+			log.Printf("Warning: resolving %v err: %v", r.Question[0], err)
+			m.Rcode = RcodeServerFailure
+		} else {
+			m.Rcode = resp.Rcode
+			m.Answer = resp.Answer
+			m.Ns = resp.Ns
+		}
+	}
+
+	err := w.WriteMsg(m)
+	if err != nil {
+		log.Printf("Warning: writing resolved response err: %v", err)
+	}
+}
+
+// resolveTimeout returns timeout, or defaultResolveTimeout if it is not set.
+func resolveTimeout(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return defaultResolveTimeout
+}
+
+// Resolve answers q with its CNAME chain followed. The returned message holds the
+// chain and the final answer, or the rcode and authority section of a negative answer.
+func (res *Resolver) Resolve(ctx context.Context, q Question) (*Msg, error) {
+	return res.resolve(ctx, q, 0)
+}
+
+func (res *Resolver) resolve(ctx context.Context, q Question, depth int) (*Msg, error) {
+	if depth > res.maxDepth() {
+		return nil, fmt.Errorf("resolving %s: too deep", q.Name)
+	}
+
+	result := &Msg{MsgHdr: MsgHdr{Response: true}}
+	seen := map[string]bool{}
+	for {
+		name := CanonicalName(q.Name)
+		if seen[name] {
+			return nil, fmt.Errorf("cname loop at %s", q.Name)
+		}
+		seen[name] = true
+
+		resp, err := res.iterate(ctx, q, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		// walk the chain as far as this response goes
+		target, answers, done := followCNAMEs(resp, q, seen)
+		result.Answer = append(result.Answer, answers...)
+		if done {
+			result.Rcode = resp.Rcode
+			result.Ns = resp.Ns
+			return result, nil
+		}
+		if len(seen) > res.maxCNAMEs()+1 {
+			return nil, fmt.Errorf("cname chain from %s too long", q.Name)
+		}
+		q = Question{Name: target, QType: q.QType, QClass: q.QClass}
+	}
+}
+
+// followCNAMEs collects the answers to q from resp, following CNAMEs within it. It
+// returns the target to continue with unless the answer is complete.
+func followCNAMEs(resp *Msg, q Question, seen map[string]bool) (string, []RR, bool) {
+	var answers []RR
+	name := q.Name
+	for {
+		var cname *CNAME
+		found := false
+		for _, rr := range resp.Answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) || h.Class != q.QClass {
+				continue
+			}
+			if h.Rrtype == q.QType {
+				answers = append(answers, rr)
+				found = true
+			} else if c, ok := rr.(*CNAME); ok && q.QType != TypeCNAME && cname == nil {
+				cname = c
+			}
+		}
+		if found || cname == nil {
+			// the final answer, or a negative answer for the last name
+			return "", answers, true
+		}
+
+		answers = append(answers, cname)
+		name = cname.Target
+		if seen[CanonicalName(name)] {
+			// a loop, let the caller fail on it
+			return name, answers, false
+		}
+		if !hasOwner(resp.Answer, name) {
+			return name, answers, false
+		}
+		seen[CanonicalName(name)] = true
+	}
+}
+
+func hasOwner(rrs []RR, name string) bool {
+	for _, rr := range rrs {
+		if strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// iterate follows referrals for q from the root until a server answers it.
+func (res *Resolver) iterate(ctx context.Context, q Question, depth int) (*Msg, error) {
+	zone := "."
+	servers := res.rootHints()
+
+	minimise := res.MinimiseQNAME
+	// labels of q.Name the servers of zone have been told about
+	labels := 0
+	steps := 0
+
+	for referrals := 0; referrals < res.maxReferrals(); {
+		ask := q
+		minimised := false
+		if minimise && labels+1 < CountLabels(q.Name) && steps < res.maxMinimise() {
+			ask = Question{Name: lastLabels(q.Name, labels+1), QType: TypeA, QClass: q.QClass}
+			minimised = true
+			steps++
+		}
+
+		resp, err := res.query(ctx, servers, zone, ask)
+		if minimised {
+			atomic.AddUint64(&res.minimised, 1)
+			usable := err == nil && resp.Rcode == RcodeSuccess && !hasCNAME(resp.Answer, ask.Name)
+			if !usable && ctx.Err() == nil {
+				// servers failing on names they don't expect, or denying empty
+				// non-terminals exist, are asked the full name from now on
+				atomic.AddUint64(&res.fallbacks, 1)
+				minimise = false
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !minimised && (resp.Rcode == RcodeNameError || len(resp.Answer) > 0) {
+			return resp, nil
+		}
+
+		child, nsNames := referral(resp, zone, ask.Name)
+		if child == "" {
+			if minimised {
+				// no zone cut here, the same servers are asked one label more
+				labels++
+				continue
+			}
+			// NODATA
+			return resp, nil
+		}
+
+		servers = res.glue(resp, zone, nsNames)
+		if len(servers) == 0 {
+			servers = res.resolveNS(ctx, nsNames, depth)
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("no usable name server for %s", child)
+		}
+		zone = child
+		labels = CountLabels(child)
+		referrals++
+	}
+
+	return nil, fmt.Errorf("resolving %s: too many referrals", q.Name)
+}
+
+// lastLabels returns the fully qualified name made of the last n labels of name.
+func lastLabels(name string, n int) string {
+	name = Fqdn(name)
+	for i := len(name) - 2; i >= 0; i-- {
+		if name[i] == '.' {
+			n--
+			if n == 0 {
+				return name[i+1:]
+			}
+		}
+	}
+	return name
+}
+
+func hasCNAME(rrs []RR, name string) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == TypeCNAME && CanonicalName(rr.Header().Name) == CanonicalName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// referral returns the delegated zone and its name server names when resp refers
+// the query for name from zone to a zone closer to it.
+func referral(resp *Msg, zone string, name string) (string, []string) {
+	child := ""
+	var nsNames []string
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*NS)
+		if !ok {
+			continue
+		}
+		owner := ns.Hdr.Name
+		// only a zone below the current one and above the name is a valid referral
+		if !IsSubDomain(zone, owner) || CanonicalName(owner) == CanonicalName(zone) || !IsSubDomain(owner, name) {
+			continue
+		}
+		if child == "" {
+			child = CanonicalName(owner)
+		}
+		if CanonicalName(owner) == child {
+			nsNames = append(nsNames, ns.Ns)
+		}
+	}
+	return child, nsNames
+}
+
+// glue returns the addresses of the name servers found in the additional section,
+// ignoring records the server of zone has no authority for.
+func (res *Resolver) glue(resp *Msg, zone string, nsNames []string) []string {
+	var addrs []string
+	for _, ns := range nsNames {
+		if !IsSubDomain(zone, ns) {
+			continue
+		}
+		for _, rr := range resp.Extra {
+			if !strings.EqualFold(rr.Header().Name, ns) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *A:
+				addrs = append(addrs, net.JoinHostPort(rr.A.String(), res.port()))
+			case *AAAA:
+				addrs = append(addrs, net.JoinHostPort(rr.AAAA.String(), res.port()))
+			}
+		}
+	}
+	return addrs
+}
+
+// resolveNS looks up the addresses of name servers the referral had no glue for,
+// stopping at the first one that resolves.
+func (res *Resolver) resolveNS(ctx context.Context, nsNames []string, depth int) []string {
+	for _, ns := range nsNames {
+		resp, err := res.resolve(ctx, Question{Name: ns, QType: TypeA, QClass: ClassINET}, depth+1)
+		if err != nil {
+			log.Printf("Warning: resolving name server %s err: %v", ns, err)
+			continue
+		}
+
+		var addrs []string
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), res.port()))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// query asks the servers of zone in turn until one gives a usable response, scrubbed
+// of anything they have no authority for.
+func (res *Resolver) query(ctx context.Context, servers []string, zone string, q Question) (*Msg, error) {
+	c := res.client()
+	if res.Use0x20 {
+		exact := *c
+		exact.ExactCase = true
+		c = &exact
+	}
+
+	var err error
+	for _, server := range servers {
+		m := &Msg{MsgHdr: MsgHdr{Id: Id()}}
+		m.Question = []Question{q}
+		if res.Use0x20 {
+			// a fresh case for every query, a retry is not easier to spoof
+			m.Question[0].Name = randomizeCase(q.Name)
+		}
+
+		var resp *Msg
+		resp, _, err = c.Exchange(ctx, m, server)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.Rcode != RcodeSuccess && resp.Rcode != RcodeNameError {
+			err = fmt.Errorf("%s answered rcode %d", server, resp.Rcode)
+			continue
+		}
+		err = Scrub(q, zone, resp)
+		if err != nil {
+			err = fmt.Errorf("%s answered %s: %v", server, q.Name, err)
+			continue
+		}
+		restoreCase(resp, m.Question[0].Name, q.Name)
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("no server answered %s, last err: %v", q.Name, err)
+}
+
+// randomizeCase flips the case of the letters in name at random.
+func randomizeCase(name string) string {
+	bits := make([]byte, len(name))
+	_, err := rand.Read(bits)
+	if err != nil {
+		panic("dns: reading random case: " + err.Error())
+	}
+
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && bits[i]&1 == 1 {
+			b[i] ^= 0x20
+		}
+	}
+	return string(b)
+}
+
+// restoreCase puts back the name asked for where the response echoes the
+// randomized one.
+func restoreCase(resp *Msg, randomized, name string) {
+	if randomized == name {
+		return
+	}
+	resp.Question[0].Name = name
+	for _, rr := range resp.Answer {
+		if rr.Header().Name == randomized {
+			rr.Header().Name = name
+		}
+	}
+}
+
+func (res *Resolver) rootHints() []string {
+	if len(res.RootHints) > 0 {
+		return res.RootHints
+	}
+	return RootHints
+}
+
+func (res *Resolver) port() string {
+	if res.Port != "" {
+		return res.Port
+	}
+	return "53"
+}
+
+func (res *Resolver) client() *Client {
+	if res.Client != nil {
+		return res.Client
+	}
+	return &Client{RandomPort: true}
+}
+
+func (res *Resolver) maxReferrals() int {
+	if res.MaxReferrals > 0 {
+		return res.MaxReferrals
+	}
+	return defaultMaxReferrals
+}
+
+func (res *Resolver) maxCNAMEs() int {
+	if res.MaxCNAMEs > 0 {
+		return res.MaxCNAMEs
+	}
+	return defaultMaxCNAMEs
+}
+
+func (res *Resolver) maxMinimise() int {
+	if res.MaxMinimise > 0 {
+		return res.MaxMinimise
+	}
+	return defaultMaxMinimise
+}
+
+func (res *Resolver) maxDepth() int {
+	if res.MaxDepth > 0 {
+		return res.MaxDepth
+	}
+	return defaultMaxDepth
+}
@@ -0,0 +1,301 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAuthority is a fake authoritative server for zones, answering from records
+// and referring queries below the NS records of other zones.
+type testAuthority struct {
+	zones   []string
+	records []RR
+
+	mu    sync.Mutex
+	asked []string
+}
+
+func (a *testAuthority) ServeDNS(w ResponseWriter, r *Msg) {
+	q := r.Question[0]
+	a.mu.Lock()
+	a.asked = append(a.asked, CanonicalName(q.Name))
+	a.mu.Unlock()
+	m := new(Msg).SetReply(r)
+
+	for _, rr := range a.records {
+		ns, ok := rr.(*NS)
+		if !ok || a.isApex(ns.Hdr.Name) || !IsSubDomain(ns.Hdr.Name, q.Name) {
+			continue
+		}
+		m.Ns = append(m.Ns, ns)
+		for _, glue := range a.records {
+			if glue.Header().Rrtype == TypeA && strings.EqualFold(glue.Header().Name, ns.Ns) {
+				m.Extra = append(m.Extra, glue)
+			}
+		}
+	}
+	if len(m.Ns) > 0 {
+		w.WriteMsg(m)
+		return
+	}
+
+	m.Authoritative = true
+	exists := false
+	for _, rr := range a.records {
+		h := rr.Header()
+		if !strings.EqualFold(h.Name, q.Name) {
+			continue
+		}
+		exists = true
+		if h.Rrtype == q.QType || h.Rrtype == TypeCNAME {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 {
+		if !exists {
+			m.Rcode = RcodeNameError
+		}
+		for _, rr := range a.records {
+			if rr.Header().Rrtype == TypeSOA && IsSubDomain(rr.Header().Name, q.Name) {
+				m.Ns = append(m.Ns, rr)
+			}
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func (a *testAuthority) isApex(name string) bool {
+	for _, zone := range a.zones {
+		if CanonicalName(zone) == CanonicalName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func testRR(name string, rrtype uint16, data string) RR {
+	hdr := RR_Header{Name: name, Rrtype: rrtype, Class: ClassINET, Ttl: 3600}
+	switch rrtype {
+	case TypeA:
+		return &A{Hdr: hdr, A: net.ParseIP(data).To4()}
+	case TypeNS:
+		return &NS{Hdr: hdr, Ns: data}
+	case TypeCNAME:
+		return &CNAME{Hdr: hdr, Target: data}
+	case TypeSOA:
+		return &SOA{Hdr: hdr, Mname: "ns1." + name, Rname: "hostmaster." + name, Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTtl: 300}
+	}
+	panic("unsupported test rr type")
+}
+
+// startTestHierarchy serves a root, a TLD and a leaf server on 127.0.0.1-3 sharing
+// one port and returns a Resolver starting from that root.
+func startTestHierarchy(t *testing.T) *Resolver {
+	res, _ := startTestAuthorities(t)
+	return res
+}
+
+// startTestAuthorities is startTestHierarchy also returning the root, TLD and leaf
+// servers.
+func startTestAuthorities(t *testing.T) (*Resolver, []*testAuthority) {
+	root := &testAuthority{
+		zones: []string{"."},
+		records: []RR{
+			testRR("com.", TypeNS, "ns.tld."),
+			testRR("net.", TypeNS, "ns.tld."),
+			testRR("ns.tld.", TypeA, "127.0.0.2"),
+		},
+	}
+	tld := &testAuthority{
+		zones: []string{"com.", "net."},
+		records: []RR{
+			testRR("example.com.", TypeNS, "ns1.example.com."),
+			testRR("ns1.example.com.", TypeA, "127.0.0.3"),
+			// out of bailiwick for net., the glue must not be used
+			testRR("other.net.", TypeNS, "ns1.example.com."),
+		},
+	}
+	leaf := &testAuthority{
+		zones: []string{"example.com.", "other.net."},
+		records: []RR{
+			testRR("example.com.", TypeSOA, ""),
+			testRR("other.net.", TypeSOA, ""),
+			testRR("ns1.example.com.", TypeA, "127.0.0.3"),
+			testRR("www.example.com.", TypeA, "192.0.2.10"),
+			// ent.example.com. is an empty non-terminal the server denies exists
+			testRR("deep.ent.example.com.", TypeA, "192.0.2.11"),
+			testRR("www.other.net.", TypeCNAME, "www.example.com."),
+			testRR("loop1.example.com.", TypeCNAME, "loop2.example.com."),
+			testRR("loop2.example.com.", TypeCNAME, "loop1.example.com."),
+		},
+	}
+
+	authorities := []*testAuthority{root, tld, leaf}
+	port := 0
+	for i, h := range authorities {
+		pc, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.%d:%d", i+1, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		port = pc.LocalAddr().(*net.UDPAddr).Port
+		srv := &Server{PacketConn: pc, Handler: h}
+		go srv.ActivateAndServe()
+		t.Cleanup(func() {
+			srv.Shutdown(context.Background())
+		})
+	}
+
+	res := &Resolver{
+		RootHints: []string{fmt.Sprintf("127.0.0.1:%d", port)},
+		Port:      fmt.Sprint(port),
+		Client:    &Client{Timeout: 200 * time.Millisecond, Attempts: 1},
+	}
+	return res, authorities
+}
+
+func TestResolverFollowsReferrals(t *testing.T) {
+	res := startTestHierarchy(t)
+
+	r, err := res.Resolve(context.Background(), Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*A).A.String() != "192.0.2.10" {
+		t.Errorf("unexpected answer %v", r.Answer)
+	}
+}
+
+func TestResolverChasesCNAMEAcrossZones(t *testing.T) {
+	res := startTestHierarchy(t)
+
+	r, err := res.Resolve(context.Background(), Question{Name: "www.other.net.", QType: TypeA, QClass: ClassINET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 2 {
+		t.Fatalf("answer = %v, want the cname and the address", r.Answer)
+	}
+	if r.Answer[0].(*CNAME).Target != "www.example.com." || r.Answer[1].(*A).A.String() != "192.0.2.10" {
+		t.Errorf("unexpected answer %v", r.Answer)
+	}
+}
+
+func TestResolverNXDOMAIN(t *testing.T) {
+	res := startTestHierarchy(t)
+
+	r, err := res.Resolve(context.Background(), Question{Name: "nothere.example.com.", QType: TypeA, QClass: ClassINET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != RcodeNameError || len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != TypeSOA {
+		t.Errorf("rcode=%d ns=%v, want NXDOMAIN with the SOA", r.Rcode, r.Ns)
+	}
+}
+
+func TestResolverCNAMELoop(t *testing.T) {
+	res := startTestHierarchy(t)
+
+	_, err := res.Resolve(context.Background(), Question{Name: "loop1.example.com.", QType: TypeA, QClass: ClassINET})
+	if err == nil {
+		t.Error("cname loop resolved")
+	}
+}
+
+func TestResolver0x20(t *testing.T) {
+	res := startTestHierarchy(t)
+	res.Use0x20 = true
+	res.Client.RandomPort = true
+
+	q := Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET}
+	r, err := res.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].Header().Name != q.Name {
+		t.Errorf("unexpected answer %v", r.Answer)
+	}
+}
+
+func TestResolver0x20DropsLowercasedEcho(t *testing.T) {
+	addr := startTestServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Msg) {
+		m := new(Msg).SetReply(r)
+		m.Question[0].Name = strings.ToLower(m.Question[0].Name)
+		m.Answer = []RR{testRR(m.Question[0].Name, TypeA, "192.0.2.1")}
+		w.WriteMsg(m)
+	})})
+	res := &Resolver{
+		RootHints: []string{addr},
+		Client:    &Client{Timeout: 100 * time.Millisecond, Attempts: 1},
+		Use0x20:   true,
+	}
+
+	// long enough for the randomized case never to come out all lower case
+	_, err := res.Resolve(context.Background(), Question{Name: "lowercasing.server.example.com.", QType: TypeA, QClass: ClassINET})
+	if err == nil {
+		t.Error("response not echoing the case accepted")
+	}
+}
+
+func TestResolverMinimisesQNAME(t *testing.T) {
+	res, authorities := startTestAuthorities(t)
+	res.MinimiseQNAME = true
+
+	r, err := res.Resolve(context.Background(), Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("unexpected answer %v", r.Answer)
+	}
+
+	// each server only learns one label more than the zone it serves
+	want := []string{"com.", "example.com.", "www.example.com."}
+	for i, a := range authorities {
+		a.mu.Lock()
+		asked := a.asked
+		a.mu.Unlock()
+		if len(asked) != 1 || asked[0] != want[i] {
+			t.Errorf("server %d asked %v, want %v", i, asked, want[i])
+		}
+	}
+	if stats := res.MinimiseStats(); stats.Minimised != 2 || stats.Fallbacks != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestResolverMinimiseFallsBack(t *testing.T) {
+	res := startTestHierarchy(t)
+	res.MinimiseQNAME = true
+
+	r, err := res.Resolve(context.Background(), Question{Name: "deep.ent.example.com.", QType: TypeA, QClass: ClassINET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*A).A.String() != "192.0.2.11" {
+		t.Errorf("unexpected answer %v", r.Answer)
+	}
+	if stats := res.MinimiseStats(); stats.Fallbacks != 1 {
+		t.Errorf("stats = %+v, want one fallback", stats)
+	}
+}
+
+func TestResolverServeDNSTimesOut(t *testing.T) {
+	// a root that never answers
+	addr := startTestServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Msg) {})})
+	res := &Resolver{RootHints: []string{addr}, Timeout: 50 * time.Millisecond}
+
+	w := &recorder{}
+	start := time.Now()
+	res.ServeDNS(w, &Msg{Question: []Question{{Name: "www.example.", QType: TypeA, QClass: ClassINET}}})
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("resolving took %v past its timeout", elapsed)
+	}
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != RcodeServerFailure {
+		t.Errorf("got %v, want SERVFAIL", w.msgs)
+	}
+}
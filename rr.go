@@ -31,5 +31,5 @@ func (h *RR_Header) unpack(msg []byte, off int) (off1 int, err error) {
 }
 
 func (h *RR_Header) len() (len int) {
-	return 8 + getDomainNameLen(h.Name)
+	return 10 + getDomainNameLen(h.Name)
 }
@@ -1,5 +1,7 @@
 package dns
 
+import "net"
+
 func (rr *A) Header() *RR_Header {
 	return &rr.Hdr
 }
@@ -32,33 +34,57 @@ func (rr *TXT) Header() *RR_Header {
 	return &rr.Hdr
 }
 
+func (rr *TSIG) Header() *RR_Header {
+	return &rr.Hdr
+}
+
+func (rr *KEY) Header() *RR_Header {
+	return &rr.Hdr
+}
+
+func (rr *SIG) Header() *RR_Header {
+	return &rr.Hdr
+}
+
 func (rr *A) len() (len int) {
-	return rr.Header().len() + int(rr.Header().Rdlength)
+	return rr.Header().len() + net.IPv4len
 }
 
 func (rr *AAAA) len() (len int) {
-	return rr.Header().len() + int(rr.Header().Rdlength)
+	return rr.Header().len() + net.IPv6len
 }
 
 func (rr *CNAME) len() (len int) {
-	return rr.Header().len() + int(rr.Header().Rdlength)
+	return rr.Header().len() + getDomainNameLen(rr.Target)
 }
 
 func (rr *NS) len() (len int) {
-	return rr.Header().len() + int(rr.Header().Rdlength)
+	return rr.Header().len() + getDomainNameLen(rr.Ns)
 }
 func (rr *MX) len() (len int) {
-	return rr.Header().len() + int(rr.Header().Rdlength)
+	return rr.Header().len() + 2 + getDomainNameLen(rr.Exchange)
 }
 func (rr *SOA) len() (len int) {
-	return rr.Header().len() + int(rr.Header().Rdlength)
+	return rr.Header().len() + getDomainNameLen(rr.Mname) + getDomainNameLen(rr.Rname) + 20
 }
 func (rr *PTR) len() (len int) {
-	return rr.Header().len() + int(rr.Header().Rdlength)
+	return rr.Header().len() + getDomainNameLen(rr.PtrDomainName)
 }
 
 func (rr *TXT) len() (len int) {
-	return rr.Header().len() + int(rr.Header().Rdlength)
+	return rr.Header().len() + getTxtLen(rr.Txt)
+}
+
+func (rr *TSIG) len() int {
+	return rr.Header().len() + getDomainNameLen(rr.Algorithm) + 16 + len(rr.MAC) + len(rr.OtherData)
+}
+
+func (rr *KEY) len() int {
+	return rr.Header().len() + 4 + len(rr.PublicKey)
+}
+
+func (rr *SIG) len() int {
+	return rr.Header().len() + 18 + getDomainNameLen(rr.SignerName) + len(rr.Signature)
 }
 
 func (rr *A) pack(msg []byte, off int, compression map[string]uint16) (off1 int, err error) {
@@ -261,3 +287,241 @@ func (rr *MX) unpack(msg []byte, off int) (off1 int, err error) {
 
 	return off, nil
 }
+
+func (rr *TSIG) pack(msg []byte, off int, compression map[string]uint16) (off1 int, err error) {
+	// the algorithm name must not be compressed
+	off, err = packDomainName(rr.Algorithm, msg, off, make(map[string]uint16))
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint48(rr.TimeSigned, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint16(rr.Fudge, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint16(uint16(len(rr.MAC)), msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packBytes(rr.MAC, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint16(rr.OrigId, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint16(rr.Error, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint16(uint16(len(rr.OtherData)), msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packBytes(rr.OtherData, msg, off)
+	if err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+func (rr *TSIG) unpack(msg []byte, off int) (off1 int, err error) {
+	rr.Algorithm, off, err = unpackDomainName(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.TimeSigned, off, err = unpackUint48(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.Fudge, off, err = unpackUint16(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.MACSize, off, err = unpackUint16(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.MAC, off, err = unpackBytes(msg, off, int(rr.MACSize))
+	if err != nil {
+		return 0, err
+	}
+	rr.OrigId, off, err = unpackUint16(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.Error, off, err = unpackUint16(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.OtherLen, off, err = unpackUint16(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.OtherData, off, err = unpackBytes(msg, off, int(rr.OtherLen))
+	if err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+func (rr *KEY) pack(msg []byte, off int, compression map[string]uint16) (off1 int, err error) {
+	off, err = packUint16(rr.Flags, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint8(rr.Protocol, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint8(rr.Algorithm, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packBytes(rr.PublicKey, msg, off)
+	if err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+func (rr *KEY) unpack(msg []byte, off int) (off1 int, err error) {
+	end := off + int(rr.Header().Rdlength)
+	rr.Flags, off, err = unpackUint16(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.Protocol, off, err = unpackUint8(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.Algorithm, off, err = unpackUint8(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.PublicKey, off, err = unpackBytes(msg, off, end-off)
+	if err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+func (rr *SIG) pack(msg []byte, off int, compression map[string]uint16) (off1 int, err error) {
+	off, err = rr.packNoSignature(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packBytes(rr.Signature, msg, off)
+	if err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+// packNoSignature packs the rdata fields a signature is computed over.
+func (rr *SIG) packNoSignature(msg []byte, off int) (off1 int, err error) {
+	off, err = packUint16(rr.TypeCovered, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint8(rr.Algorithm, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint8(rr.Labels, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint32(rr.OrigTtl, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint32(rr.Expiration, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint32(rr.Inception, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	off, err = packUint16(rr.KeyTag, msg, off)
+	if err != nil {
+		return 0, err
+	}
+	// the signer name must not be compressed
+	off, err = packDomainName(rr.SignerName, msg, off, make(map[string]uint16))
+	if err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+func (rr *SIG) unpack(msg []byte, off int) (off1 int, err error) {
+	end := off + int(rr.Header().Rdlength)
+	rr.TypeCovered, off, err = unpackUint16(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.Algorithm, off, err = unpackUint8(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.Labels, off, err = unpackUint8(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.OrigTtl, off, err = unpackUint32(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.Expiration, off, err = unpackUint32(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.Inception, off, err = unpackUint32(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.KeyTag, off, err = unpackUint16(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.SignerName, off, err = unpackDomainName(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	rr.Signature, off, err = unpackBytes(msg, off, end-off)
+	if err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+func (rr *RFC3597) Header() *RR_Header {
+	return &rr.Hdr
+}
+func (rr *RFC3597) len() int {
+	return rr.Header().len() + len(rr.Rdata)
+}
+func (rr *RFC3597) pack(msg []byte, off int, compression map[string]uint16) (off1 int, err error) {
+	return packBytes(rr.Rdata, msg, off)
+}
+func (rr *RFC3597) unpack(msg []byte, off int) (off1 int, err error) {
+	rr.Rdata, off, err = unpackBytes(msg, off, int(rr.Header().Rdlength))
+	if err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
@@ -50,3 +50,44 @@ type PTR struct {
 	Hdr           RR_Header
 	PtrDomainName string
 }
+
+type TSIG struct {
+	Hdr        RR_Header
+	Algorithm  string
+	TimeSigned uint64
+	Fudge      uint16
+	MACSize    uint16
+	MAC        []byte
+	OrigId     uint16
+	Error      uint16
+	OtherLen   uint16
+	OtherData  []byte
+}
+
+type KEY struct {
+	Hdr       RR_Header
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+type SIG struct {
+	Hdr         RR_Header
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OrigTtl     uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+}
+
+// RFC3597 is a record of a type this package doesn't know, with its rdata kept as
+// it is (RFC 3597).
+type RFC3597 struct {
+	Hdr   RR_Header
+	Rdata []byte
+}
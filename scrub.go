@@ -0,0 +1,113 @@
+package dns
+
+import "errors"
+
+var (
+	ErrScrubQuestion = errors.New("response question does not match query")
+	ErrScrubCNAME    = errors.New("inconsistent cname chain")
+)
+
+// Scrub strips resp, the response to q from a server authoritative for zone, down
+// to what may be trusted and cached:
+//   - the answer keeps the CNAME chain from q.Name and the records at its end,
+//     all within zone;
+//   - the authority keeps the NS and SOA records within zone above that name;
+//   - the additional keeps addresses of name servers and mail exchangers named
+//     in the kept records, within zone.
+//
+// A forwarder trusting its upstream for everything uses the root as zone. An error
+// means the response should be discarded as a whole.
+func Scrub(q Question, zone string, resp *Msg) error {
+	if len(resp.Question) != 1 {
+		return ErrScrubQuestion
+	}
+	rq := resp.Question[0]
+	if rq.QType != q.QType || rq.QClass != q.QClass || CanonicalName(rq.Name) != CanonicalName(q.Name) {
+		return ErrScrubQuestion
+	}
+
+	answers, name, err := scrubAnswer(q, zone, resp.Answer)
+	if err != nil {
+		return err
+	}
+	resp.Answer = answers
+
+	wanted := map[string]bool{}
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *NS:
+			wanted[CanonicalName(rr.Ns)] = true
+		case *MX:
+			wanted[CanonicalName(rr.Exchange)] = true
+		}
+	}
+
+	var ns []RR
+	for _, rr := range resp.Ns {
+		h := rr.Header()
+		if !IsSubDomain(zone, h.Name) || !IsSubDomain(h.Name, name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *NS:
+			wanted[CanonicalName(rr.Ns)] = true
+			ns = append(ns, rr)
+		case *SOA:
+			ns = append(ns, rr)
+		}
+	}
+	resp.Ns = ns
+
+	var extra []RR
+	for _, rr := range resp.Extra {
+		h := rr.Header()
+		if h.Rrtype != TypeA && h.Rrtype != TypeAAAA {
+			continue
+		}
+		if !wanted[CanonicalName(h.Name)] || !IsSubDomain(zone, h.Name) {
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	resp.Extra = extra
+
+	return nil
+}
+
+// scrubAnswer keeps the CNAME chain starting at q.Name and the records of q.QType
+// at its end, and returns them with the last name of the chain. A TypeANY question
+// keeps every record at q.Name, a CNAME as any other.
+func scrubAnswer(q Question, zone string, answers []RR) ([]RR, string, error) {
+	var kept []RR
+	name := q.Name
+	seen := map[string]bool{}
+	for {
+		if seen[CanonicalName(name)] {
+			return nil, "", ErrScrubCNAME
+		}
+		seen[CanonicalName(name)] = true
+
+		var cnames, data []RR
+		for _, rr := range answers {
+			h := rr.Header()
+			if h.Class != q.QClass || CanonicalName(h.Name) != CanonicalName(name) || !IsSubDomain(zone, h.Name) {
+				continue
+			}
+			if h.Rrtype == TypeCNAME && q.QType != TypeCNAME && q.QType != TypeANY {
+				cnames = append(cnames, rr)
+			} else if h.Rrtype == q.QType || q.QType == TypeANY {
+				data = append(data, rr)
+			}
+		}
+
+		// a name with a CNAME has no other data
+		if len(cnames) > 1 || len(cnames) == 1 && len(data) > 0 {
+			return nil, "", ErrScrubCNAME
+		}
+		if len(cnames) == 0 {
+			return append(kept, data...), name, nil
+		}
+		kept = append(kept, cnames[0])
+		name = cnames[0].(*CNAME).Target
+	}
+}
@@ -0,0 +1,100 @@
+package dns
+
+import "testing"
+
+func testScrubResponse(q Question, answer, ns, extra []RR) *Msg {
+	m := &Msg{MsgHdr: MsgHdr{Response: true}, Question: []Question{q}}
+	m.Answer, m.Ns, m.Extra = answer, ns, extra
+	return m
+}
+
+func TestScrubBailiwick(t *testing.T) {
+	q := Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET}
+	resp := testScrubResponse(q,
+		[]RR{
+			testRR("www.example.com.", TypeCNAME, "web.example.com."),
+			testRR("web.example.com.", TypeA, "192.0.2.1"),
+			// not on the chain
+			testRR("mail.example.com.", TypeA, "192.0.2.2"),
+			// poisoning attempt for another zone
+			testRR("www.bank.test.", TypeA, "203.0.113.66"),
+		},
+		[]RR{
+			testRR("example.com.", TypeNS, "ns1.example.com."),
+			testRR("bank.test.", TypeNS, "ns.evil.test."),
+		},
+		[]RR{
+			testRR("ns1.example.com.", TypeA, "192.0.2.53"),
+			testRR("ns.evil.test.", TypeA, "203.0.113.53"),
+			testRR("unrelated.example.com.", TypeA, "192.0.2.99"),
+		},
+	)
+
+	err := Scrub(q, "example.com.", resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 2 || resp.Answer[1].Header().Name != "web.example.com." {
+		t.Errorf("answer = %v", resp.Answer)
+	}
+	if len(resp.Ns) != 1 || resp.Ns[0].Header().Name != "example.com." {
+		t.Errorf("ns = %v", resp.Ns)
+	}
+	if len(resp.Extra) != 1 || resp.Extra[0].Header().Name != "ns1.example.com." {
+		t.Errorf("extra = %v", resp.Extra)
+	}
+}
+
+func TestScrubAny(t *testing.T) {
+	q := Question{Name: "example.com.", QType: TypeANY, QClass: ClassINET}
+	resp := testScrubResponse(q,
+		[]RR{
+			testRR("example.com.", TypeA, "192.0.2.1"),
+			testRR("example.com.", TypeNS, "ns1.example.com."),
+			testRR("example.com.", TypeSOA, ""),
+			// another name
+			testRR("www.example.com.", TypeA, "192.0.2.2"),
+		},
+		nil, nil,
+	)
+
+	err := Scrub(q, "example.com.", resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 3 {
+		t.Errorf("answer = %v", resp.Answer)
+	}
+
+	// out of bailiwick records are dropped all the same
+	resp = testScrubResponse(q, []RR{testRR("example.com.", TypeA, "192.0.2.1")}, nil, nil)
+	err = Scrub(q, "example.net.", resp)
+	if err != nil || len(resp.Answer) != 0 {
+		t.Errorf("out of bailiwick answer = %v, %v", resp.Answer, err)
+	}
+}
+
+func TestScrubRejects(t *testing.T) {
+	q := Question{Name: "www.example.com.", QType: TypeA, QClass: ClassINET}
+	tests := map[string]*Msg{
+		"other question": testScrubResponse(Question{Name: "www.example.net.", QType: TypeA, QClass: ClassINET}, nil, nil, nil),
+		"other type":     testScrubResponse(Question{Name: "www.example.com.", QType: TypeAAAA, QClass: ClassINET}, nil, nil, nil),
+		"two cnames": testScrubResponse(q, []RR{
+			testRR("www.example.com.", TypeCNAME, "a.example.com."),
+			testRR("www.example.com.", TypeCNAME, "b.example.com."),
+		}, nil, nil),
+		"cname and data": testScrubResponse(q, []RR{
+			testRR("www.example.com.", TypeCNAME, "a.example.com."),
+			testRR("www.example.com.", TypeA, "192.0.2.1"),
+		}, nil, nil),
+		"cname loop": testScrubResponse(q, []RR{
+			testRR("www.example.com.", TypeCNAME, "a.example.com."),
+			testRR("a.example.com.", TypeCNAME, "WWW.example.com."),
+		}, nil, nil),
+	}
+	for name, resp := range tests {
+		if err := Scrub(q, ".", resp); err == nil {
+			t.Errorf("%s: not rejected", name)
+		}
+	}
+}
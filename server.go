@@ -0,0 +1,554 @@
+package dns
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	MinMsgSize = 512
+	MaxMsgSize = 65535
+
+	defaultReadTimeout  = 2 * time.Second
+	defaultWriteTimeout = 2 * time.Second
+)
+
+type Handler interface {
+	ServeDNS(w ResponseWriter, r *Msg)
+}
+
+type HandlerFunc func(ResponseWriter, *Msg)
+
+func (f HandlerFunc) ServeDNS(w ResponseWriter, r *Msg) {
+	f(w, r)
+}
+
+type ResponseWriter interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	// WriteMsg packs and writes m, truncating it for UDP and signing it when the
+	// request carried a valid TSIG. It may be called several times over TCP.
+	WriteMsg(m *Msg) error
+	// Write writes packed wire data as is.
+	Write(b []byte) (int, error)
+	// TsigStatus is nil if the request had no TSIG or a valid one.
+	TsigStatus() error
+	// Close closes the TCP connection after the handler returns, a no-op for UDP.
+	Close() error
+}
+
+// Server serves DNS over UDP and TCP. Net selects "udp" or "tcp", empty serves
+// both on Addr. PacketConn and Listener may be set instead to serve on existing sockets.
+type Server struct {
+	Addr       string
+	Net        string
+	Handler    Handler
+	PacketConn net.PacketConn
+	Listener   net.Listener
+
+	// ReadTimeout bounds reading a TCP query, including the wait for the next one
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// MaxTCPConnections stops accepting while that many connections are open, 0 is unlimited
+	MaxTCPConnections int
+	// UDPSize is the largest UDP response before it is truncated, MinMsgSize by default
+	UDPSize int
+	// TsigKeyRing verifies request TSIGs and signs their responses
+	TsigKeyRing TsigKeyRing
+	// NotifyStartedFunc is called once the server serves
+	NotifyStartedFunc func()
+
+	lock     sync.Mutex
+	started  bool
+	shutdown chan struct{}
+	conns    map[net.Conn]struct{}
+	tcpSlots chan struct{}
+	wg       sync.WaitGroup
+
+	// shuttingDown is set by a Shutdown before the server started
+	shuttingDown bool
+}
+
+func (srv *Server) ListenAndServe() error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":53"
+	}
+
+	switch srv.Net {
+	case "udp", "udp4", "udp6":
+		pc, err := net.ListenPacket(srv.Net, addr)
+		if err != nil {
+			return fmt.Errorf("listening udp err: %v", err)
+		}
+		srv.PacketConn = pc
+	case "tcp", "tcp4", "tcp6":
+		l, err := net.Listen(srv.Net, addr)
+		if err != nil {
+			return fmt.Errorf("listening tcp err: %v", err)
+		}
+		srv.Listener = l
+	case "":
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return fmt.Errorf("listening udp err: %v", err)
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			pc.Close()
+			return fmt.Errorf("listening tcp err: %v", err)
+		}
+		srv.PacketConn = pc
+		srv.Listener = l
+	default:
+		return fmt.Errorf("unsupported net %s", srv.Net)
+	}
+
+	return srv.ActivateAndServe()
+}
+
+// ActivateAndServe serves on PacketConn and Listener, whichever are set, until
+// Shutdown or an error. It returns at once, closing them, if Shutdown came first.
+func (srv *Server) ActivateAndServe() error {
+	srv.lock.Lock()
+	if srv.started {
+		srv.lock.Unlock()
+		return fmt.Errorf("server already started")
+	}
+	if srv.shuttingDown {
+		srv.lock.Unlock()
+		srv.closeListeners()
+		return nil
+	}
+	if srv.Handler == nil {
+		srv.lock.Unlock()
+		return fmt.Errorf("server has no handler")
+	}
+	pc, l := srv.PacketConn, srv.Listener
+	if pc == nil && l == nil {
+		srv.lock.Unlock()
+		return fmt.Errorf("server has no listener")
+	}
+	srv.started = true
+	srv.shutdown = make(chan struct{})
+	srv.conns = make(map[net.Conn]struct{})
+	if srv.MaxTCPConnections > 0 {
+		srv.tcpSlots = make(chan struct{}, srv.MaxTCPConnections)
+	}
+	srv.lock.Unlock()
+	if srv.NotifyStartedFunc != nil {
+		srv.NotifyStartedFunc()
+	}
+
+	errCh := make(chan error, 2)
+	n := 0
+	if pc != nil {
+		n++
+		go func() {
+			errCh <- srv.serveUDP(pc)
+		}()
+	}
+	if l != nil {
+		n++
+		go func() {
+			errCh <- srv.serveTCP(l)
+		}()
+	}
+
+	var err error
+	for i := 0; i < n; i++ {
+		e := <-errCh
+		if e != nil && err == nil {
+			err = e
+			// don't keep serving half of the server
+			srv.stopListening()
+		}
+	}
+	return err
+}
+
+// Shutdown stops accepting queries and waits for the in-flight ones to be answered
+// until ctx is done, then closes the sockets. A server not started yet never will.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.lock.Lock()
+	if !srv.started {
+		srv.shuttingDown = true
+		srv.lock.Unlock()
+		srv.closeListeners()
+		return nil
+	}
+	srv.lock.Unlock()
+
+	srv.stopListening()
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		srv.lock.Lock()
+		for conn := range srv.conns {
+			conn.Close()
+		}
+		srv.lock.Unlock()
+	}
+
+	if srv.PacketConn != nil {
+		srv.PacketConn.Close()
+	}
+	return err
+}
+
+// closeListeners closes the sockets of a server that never served on them.
+func (srv *Server) closeListeners() {
+	srv.lock.Lock()
+	pc, l := srv.PacketConn, srv.Listener
+	srv.lock.Unlock()
+	if pc != nil {
+		pc.Close()
+	}
+	if l != nil {
+		l.Close()
+	}
+}
+
+func (srv *Server) stopListening() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	select {
+	case <-srv.shutdown:
+		return
+	default:
+	}
+	close(srv.shutdown)
+
+	// UDP handlers still answer on PacketConn, so only wake up the reader here
+	if srv.PacketConn != nil {
+		srv.PacketConn.SetReadDeadline(time.Now())
+	}
+	if srv.Listener != nil {
+		srv.Listener.Close()
+	}
+	for conn := range srv.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (srv *Server) isShutdown() bool {
+	select {
+	case <-srv.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// track registers an in-flight query or connection, it fails once shut down.
+func (srv *Server) track(conn net.Conn) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.isShutdown() {
+		return false
+	}
+	if conn != nil {
+		srv.conns[conn] = struct{}{}
+	}
+	srv.wg.Add(1)
+	return true
+}
+
+func (srv *Server) untrack(conn net.Conn) {
+	if conn != nil {
+		srv.lock.Lock()
+		delete(srv.conns, conn)
+		srv.lock.Unlock()
+	}
+	srv.wg.Done()
+}
+
+func (srv *Server) serveUDP(pc net.PacketConn) error {
+	// reads go one at a time into buf, each request is copied out of it
+	buf := make([]byte, MaxMsgSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if srv.isShutdown() {
+				return nil
+			}
+			return fmt.Errorf("reading udp err: %v", err)
+		}
+		if n < HeaderSize {
+			continue
+		}
+		if !srv.track(nil) {
+			return nil
+		}
+
+		data := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer srv.untrack(nil)
+			srv.serveDNS(data, &response{srv: srv, pc: pc, remote: addr})
+		}()
+	}
+}
+
+func (srv *Server) serveTCP(l net.Listener) error {
+	for {
+		if srv.tcpSlots != nil {
+			select {
+			case srv.tcpSlots <- struct{}{}:
+			case <-srv.shutdown:
+				return nil
+			}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			srv.releaseTCPSlot()
+			if srv.isShutdown() {
+				return nil
+			}
+			return fmt.Errorf("accepting tcp err: %v", err)
+		}
+		if !srv.track(conn) {
+			conn.Close()
+			srv.releaseTCPSlot()
+			return nil
+		}
+
+		go srv.serveTCPConn(conn)
+	}
+}
+
+func (srv *Server) releaseTCPSlot() {
+	if srv.tcpSlots != nil {
+		<-srv.tcpSlots
+	}
+}
+
+func (srv *Server) serveTCPConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		srv.releaseTCPSlot()
+		srv.untrack(conn)
+	}()
+
+	for !srv.isShutdown() {
+		err := conn.SetReadDeadline(time.Now().Add(srv.readTimeout()))
+		if err != nil {
+			return
+		}
+		data, err := readTCPMsg(conn)
+		if err != nil {
+			return
+		}
+
+		w := &response{srv: srv, conn: conn}
+		srv.serveDNS(data, w)
+		if w.closed {
+			return
+		}
+	}
+}
+
+func (srv *Server) serveDNS(data []byte, w *response) {
+	req := new(Msg)
+	err := req.Unpack(data)
+	if err != nil {
+		// answer FORMERR when at least the header made it, never to a response
+		if len(data) > 2 && data[2]&0x80 != 0 {
+			return
+		}
+		m := &Msg{MsgHdr: MsgHdr{
+			Id:       binary.BigEndian.Uint16(data),
+			Response: true,
+			Rcode:    RcodeFormatError,
+		}}
+		err = w.WriteMsg(m)
+		if err != nil {
+			log.Printf("Warning: writing formerr err: %v", err)
+		}
+		return
+	}
+	if req.Response {
+		return
+	}
+
+	if rr := req.IsTsig(); rr != nil {
+		w.tsigStatus = ErrTsigBadKey
+		if srv.TsigKeyRing != nil {
+			_, w.tsigStatus = TsigVerifyWithKeyRing(data, srv.TsigKeyRing, nil, false)
+		}
+		if w.tsigStatus == nil {
+			key, _ := srv.TsigKeyRing.GetKey(rr.Hdr.Name)
+			w.tsig = &TsigStream{Key: key, RequestMAC: rr.MAC}
+		}
+	}
+
+	srv.Handler.ServeDNS(w, req)
+}
+
+func (srv *Server) readTimeout() time.Duration {
+	if srv.ReadTimeout > 0 {
+		return srv.ReadTimeout
+	}
+	return defaultReadTimeout
+}
+
+func (srv *Server) writeTimeout() time.Duration {
+	if srv.WriteTimeout > 0 {
+		return srv.WriteTimeout
+	}
+	return defaultWriteTimeout
+}
+
+func (srv *Server) udpSize() int {
+	if srv.UDPSize > 0 {
+		return srv.UDPSize
+	}
+	return MinMsgSize
+}
+
+type response struct {
+	srv    *Server
+	pc     net.PacketConn
+	remote net.Addr
+	conn   net.Conn
+
+	tsig       *TsigStream
+	tsigStatus error
+	closed     bool
+}
+
+func (w *response) LocalAddr() net.Addr {
+	if w.conn != nil {
+		return w.conn.LocalAddr()
+	}
+	return w.pc.LocalAddr()
+}
+
+func (w *response) RemoteAddr() net.Addr {
+	if w.conn != nil {
+		return w.conn.RemoteAddr()
+	}
+	return w.remote
+}
+
+func (w *response) WriteMsg(m *Msg) error {
+	if w.pc != nil {
+		data, err := m.Pack()
+		if err != nil {
+			return err
+		}
+		if len(data)+w.tsigLen() > w.srv.udpSize() {
+			tc := &Msg{
+				MsgHdr:   m.MsgHdr,
+				Question: m.Question,
+			}
+			tc.Truncated = true
+			m = tc
+		}
+	}
+
+	var data []byte
+	var err error
+	if w.tsig != nil {
+		data, err = w.tsig.Sign(m)
+	} else {
+		data, err = m.Pack()
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// tsigLen is the room the TSIG of the response will take.
+func (w *response) tsigLen() int {
+	if w.tsig == nil {
+		return 0
+	}
+	rr := &TSIG{
+		Hdr:       RR_Header{Name: w.tsig.Key.Name},
+		Algorithm: w.tsig.Key.Algorithm,
+		MAC:       make([]byte, sha512.Size),
+	}
+	return rr.len()
+}
+
+func (w *response) Write(b []byte) (int, error) {
+	if w.conn != nil {
+		err := w.conn.SetWriteDeadline(time.Now().Add(w.srv.writeTimeout()))
+		if err != nil {
+			return 0, err
+		}
+		err = writeTCPMsg(w.conn, b)
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	err := w.pc.SetWriteDeadline(time.Now().Add(w.srv.writeTimeout()))
+	if err != nil {
+		return 0, err
+	}
+	return w.pc.WriteTo(b, w.remote)
+}
+
+func (w *response) TsigStatus() error {
+	return w.tsigStatus
+}
+
+func (w *response) Close() error {
+	w.closed = true
+	return nil
+}
+
+// readTCPMsg reads one message with its 2-byte length prefix.
+func readTCPMsg(conn net.Conn) ([]byte, error) {
+	var l [2]byte
+	_, err := io.ReadFull(conn, l[:])
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if n < HeaderSize {
+		return nil, fmt.Errorf("short tcp message of %d bytes", n)
+	}
+
+	buf := make([]byte, n)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func writeTCPMsg(conn net.Conn, data []byte) error {
+	if len(data) > MaxMsgSize {
+		return fmt.Errorf("message of %d bytes too large for tcp", len(data))
+	}
+
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+	_, err := conn.Write(buf)
+	return err
+}
@@ -0,0 +1,240 @@
+package dns
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestServer serves handler on UDP and TCP loopback sockets sharing one port.
+func startTestServer(t *testing.T, srv *Server) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.PacketConn = pc
+	srv.Listener = l
+
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ActivateAndServe()
+	}()
+	select {
+	case <-started:
+	case err = <-errCh:
+		t.Fatalf("ActivateAndServe: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+		err = <-errCh
+		if err != nil {
+			t.Errorf("ActivateAndServe: %v", err)
+		}
+	})
+
+	return pc.LocalAddr().String()
+}
+
+func testAnswerHandler(count int) HandlerFunc {
+	return func(w ResponseWriter, r *Msg) {
+		m := &Msg{
+			MsgHdr:   MsgHdr{Id: r.Id, Response: true, RecursionDesired: r.RecursionDesired},
+			Question: r.Question,
+		}
+		for i := 0; i < count; i++ {
+			m.Answer = append(m.Answer, &A{
+				Hdr: RR_Header{Name: r.Question[0].Name, Rrtype: TypeA, Class: ClassINET, Ttl: 300},
+				A:   net.IP{192, 0, 2, byte(i)},
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestServerUDPAndTCP(t *testing.T) {
+	addr := startTestServer(t, &Server{Handler: testAnswerHandler(1)})
+
+	for _, network := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: network}
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.", dns.TypeA)
+		r, _, err := c.Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.0" {
+			t.Errorf("%s: unexpected answer %v", network, r.Answer)
+		}
+	}
+}
+
+func TestServerTruncatesUDP(t *testing.T) {
+	addr := startTestServer(t, &Server{Handler: testAnswerHandler(60)})
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.", dns.TypeA)
+	r, _, err := (&dns.Client{Net: "udp"}).Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Truncated || len(r.Answer) != 0 {
+		t.Errorf("udp response not truncated: tc=%v answers=%d", r.Truncated, len(r.Answer))
+	}
+
+	r, _, err = (&dns.Client{Net: "tcp"}).Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated || len(r.Answer) != 60 {
+		t.Errorf("tcp response: tc=%v answers=%d", r.Truncated, len(r.Answer))
+	}
+}
+
+func TestServerFormErr(t *testing.T) {
+	addr := startTestServer(t, &Server{Handler: testAnswerHandler(1)})
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a response as broken gets no answer
+	_, err = conn.Write([]byte{0x43, 0x21, 0x80, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header announcing a question that isn't there
+	_, err = conn.Write([]byte{0x12, 0x34, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, MinMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r Msg
+	err = r.Unpack(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != 0x1234 || r.Rcode != RcodeFormatError {
+		t.Errorf("id=%#x rcode=%d, want formerr", r.Id, r.Rcode)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(buf)
+	if err == nil {
+		t.Error("broken response answered")
+	}
+}
+
+func TestServerTsig(t *testing.T) {
+	var ring MemoryTsigKeyRing
+	err := ring.AddKey(*testTsigKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := testAnswerHandler(1)
+	addr := startTestServer(t, &Server{
+		TsigKeyRing: &ring,
+		Handler: HandlerFunc(func(w ResponseWriter, r *Msg) {
+			if w.TsigStatus() != nil {
+				t.Errorf("TsigStatus: %v", w.TsigStatus())
+			}
+			handler(w, r)
+		}),
+	})
+
+	c := &dns.Client{
+		Net:        "tcp",
+		TsigSecret: map[string]string{testTsigKey.Name: base64.StdEncoding.EncodeToString(testTsigKey.Secret)},
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.", dns.TypeA)
+	m.SetTsig(testTsigKey.Name, dns.HmacSHA256, DefaultTsigFudge, time.Now().Unix())
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.IsTsig() == nil {
+		t.Error("response is not signed")
+	}
+}
+
+func TestServerShutdownWaitsForHandlers(t *testing.T) {
+	started := make(chan struct{})
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Msg) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		testAnswerHandler(1)(w, r)
+	})}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.PacketConn = pc
+	serving := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(serving) }
+	go srv.ActivateAndServe()
+	<-serving
+
+	result := make(chan error, 1)
+	go func() {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.", dns.TypeA)
+		_, _, err := (&dns.Client{Net: "udp"}).Exchange(m, pc.LocalAddr().String())
+		result <- err
+	}()
+
+	<-started
+	err = srv.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-result
+	if err != nil {
+		t.Errorf("in-flight query was not answered: %v", err)
+	}
+}
+
+func TestServerShutdownBeforeStart(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Handler: testAnswerHandler(1), PacketConn: pc}
+	err = srv.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ActivateAndServe()
+	}()
+	select {
+	case err = <-errCh:
+		if err != nil {
+			t.Errorf("ActivateAndServe: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server started after Shutdown")
+	}
+}
@@ -0,0 +1,307 @@
+package dns
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sig0Validity is how long around the signing time a SIG(0) is valid.
+const Sig0Validity = 5 * time.Minute
+
+var (
+	ErrSig0Missing = errors.New("message has no sig(0)")
+	ErrSig0BadKey  = errors.New("bad sig(0) key")
+	ErrSig0BadSig  = errors.New("bad sig(0) signature")
+	ErrSig0BadTime = errors.New("bad sig(0) time")
+)
+
+// NewKEY returns the KEY record publishing pub under name, pub being an
+// ed25519.PublicKey or an *ecdsa.PublicKey on P-256 or P-384.
+func NewKEY(name string, pub crypto.PublicKey) (*KEY, error) {
+	rr := &KEY{
+		Hdr: RR_Header{
+			Name:   Fqdn(name),
+			Rrtype: TypeKEY,
+			Class:  ClassINET,
+		},
+		Protocol: 3,
+	}
+
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		rr.Algorithm = ED25519
+		rr.PublicKey = CloneSlice(pub)
+	case *ecdsa.PublicKey:
+		size := 0
+		switch pub.Curve {
+		case elliptic.P256():
+			rr.Algorithm, size = ECDSAP256SHA256, 32
+		case elliptic.P384():
+			rr.Algorithm, size = ECDSAP384SHA384, 48
+		default:
+			return nil, fmt.Errorf("unsupported ecdsa curve %s", pub.Curve.Params().Name)
+		}
+		rr.PublicKey = append(intToBytes(pub.X, size), intToBytes(pub.Y, size)...)
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	return rr, nil
+}
+
+// KeyTag computes the key tag of rr (RFC 4034 appendix B).
+func (rr *KEY) KeyTag() uint16 {
+	buf := make([]byte, 4+len(rr.PublicKey))
+	_, err := rr.pack(buf, 0, nil)
+	if err != nil {
+		return 0
+	}
+
+	var tag uint32
+	for i, b := range buf {
+		if i&1 == 0 {
+			tag += uint32(b) << 8
+		} else {
+			tag += uint32(b)
+		}
+	}
+	tag += tag >> 16 & 0xFFFF
+	return uint16(tag & 0xFFFF)
+}
+
+func (rr *KEY) publicKey() (crypto.PublicKey, error) {
+	switch rr.Algorithm {
+	case ED25519:
+		if len(rr.PublicKey) != ed25519.PublicKeySize {
+			return nil, ErrSig0BadKey
+		}
+		return ed25519.PublicKey(rr.PublicKey), nil
+	case ECDSAP256SHA256, ECDSAP384SHA384:
+		curve, size := elliptic.P256(), 32
+		if rr.Algorithm == ECDSAP384SHA384 {
+			curve, size = elliptic.P384(), 48
+		}
+		if len(rr.PublicKey) != 2*size {
+			return nil, ErrSig0BadKey
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(rr.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(rr.PublicKey[size:]),
+		}, nil
+	}
+	return nil, ErrSig0BadKey
+}
+
+type Sig0KeyStore interface {
+	GetKey(signerName string, keyTag uint16, algorithm uint8) (*KEY, error)
+}
+
+// MemorySig0KeyStore keeps the KEY records of every signer, e.g. one signer name per tenant.
+type MemorySig0KeyStore struct {
+	mu   sync.RWMutex
+	keys map[string][]*KEY
+}
+
+func (store *MemorySig0KeyStore) AddKey(key *KEY) error {
+	if _, err := key.publicKey(); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.keys == nil {
+		store.keys = make(map[string][]*KEY)
+	}
+	name := CanonicalName(key.Hdr.Name)
+	store.keys[name] = append(store.keys[name], key)
+	return nil
+}
+
+func (store *MemorySig0KeyStore) RemoveKey(signerName string, keyTag uint16) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	name := CanonicalName(signerName)
+	keys := store.keys[name][:0]
+	for _, key := range store.keys[name] {
+		if key.KeyTag() != keyTag {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		delete(store.keys, name)
+	} else {
+		store.keys[name] = keys
+	}
+}
+
+func (store *MemorySig0KeyStore) GetKey(signerName string, keyTag uint16, algorithm uint8) (*KEY, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	for _, key := range store.keys[CanonicalName(signerName)] {
+		if key.Algorithm == algorithm && key.KeyTag() == keyTag {
+			return key, nil
+		}
+	}
+	return nil, ErrSig0BadKey
+}
+
+// Sig0Sign appends a SIG(0) made by signer, the private half of key, to msg and
+// returns the signed wire data. request is the signed request when msg is its response.
+func Sig0Sign(msg *Msg, key *KEY, signer crypto.Signer, request []byte) ([]byte, error) {
+	now := timeNow()
+	rr := &SIG{
+		Hdr: RR_Header{
+			Name:   ".",
+			Rrtype: TypeSIG,
+			Class:  ClassANY,
+			Ttl:    0,
+		},
+		Algorithm:  key.Algorithm,
+		Expiration: uint32(now.Add(Sig0Validity).Unix()),
+		Inception:  uint32(now.Add(-Sig0Validity).Unix()),
+		KeyTag:     key.KeyTag(),
+		SignerName: CanonicalName(key.Hdr.Name),
+	}
+
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	data, err := sig0Data(buf, rr, request)
+	if err != nil {
+		return nil, err
+	}
+
+	switch rr.Algorithm {
+	case ED25519:
+		rr.Signature, err = signer.Sign(rand.Reader, data, crypto.Hash(0))
+		if err != nil {
+			return nil, fmt.Errorf("signing err: %v", err)
+		}
+	case ECDSAP256SHA256, ECDSAP384SHA384:
+		hashed, hash, size := sig0Hash(rr.Algorithm, data)
+		der, err := signer.Sign(rand.Reader, hashed, hash)
+		if err != nil {
+			return nil, fmt.Errorf("signing err: %v", err)
+		}
+		var sig struct {
+			R, S *big.Int
+		}
+		_, err = asn1.Unmarshal(der, &sig)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshaling ecdsa signature err: %v", err)
+		}
+		rr.Signature = append(intToBytes(sig.R, size), intToBytes(sig.S, size)...)
+	default:
+		return nil, fmt.Errorf("unsupported sig(0) algorithm %d", rr.Algorithm)
+	}
+
+	msg.Extra = append(msg.Extra, rr)
+	return msg.Pack()
+}
+
+// Sig0Verify checks the SIG(0) closing the wire message data against the keys in
+// store and returns the key it was made with. request is the signed request when
+// data is its response.
+func Sig0Verify(data []byte, store Sig0KeyStore, request []byte) (*KEY, error) {
+	buf, last, err := splitLastExtra(data)
+	if err == errNoExtra {
+		return nil, ErrSig0Missing
+	}
+	if err != nil {
+		return nil, err
+	}
+	rr, ok := last.(*SIG)
+	if !ok || rr.TypeCovered != 0 {
+		return nil, ErrSig0Missing
+	}
+
+	key, err := store.GetKey(rr.SignerName, rr.KeyTag, rr.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(Fqdn(key.Hdr.Name), rr.SignerName) {
+		return nil, ErrSig0BadKey
+	}
+	pub, err := key.publicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := sig0Data(buf, rr, request)
+	if err != nil {
+		return nil, err
+	}
+
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, signed, rr.Signature) {
+			return nil, ErrSig0BadSig
+		}
+	case *ecdsa.PublicKey:
+		hashed, _, size := sig0Hash(rr.Algorithm, signed)
+		if len(rr.Signature) != 2*size {
+			return nil, ErrSig0BadSig
+		}
+		r := new(big.Int).SetBytes(rr.Signature[:size])
+		s := new(big.Int).SetBytes(rr.Signature[size:])
+		if !ecdsa.Verify(pub, hashed, r, s) {
+			return nil, ErrSig0BadSig
+		}
+	}
+
+	now := uint32(timeNow().Unix())
+	if now < rr.Inception || now > rr.Expiration {
+		return nil, ErrSig0BadTime
+	}
+
+	return key, nil
+}
+
+// sig0Data is what a SIG(0) signs: its rdata without the signature, the request
+// for a response, then the message without the SIG(0) (RFC 2931 section 3.1).
+func sig0Data(buf []byte, rr *SIG, request []byte) ([]byte, error) {
+	rdata := make([]byte, 18+getDomainNameLen(rr.SignerName))
+	off, err := rr.packNoSignature(rdata, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, off+len(request)+len(buf))
+	data = append(data, rdata[:off]...)
+	data = append(data, request...)
+	data = append(data, buf...)
+	return data, nil
+}
+
+// sig0Hash returns the digest of data an ECDSA signature is made over and the size of r and s.
+func sig0Hash(algorithm uint8, data []byte) ([]byte, crypto.Hash, int) {
+	if algorithm == ECDSAP384SHA384 {
+		h := sha512.Sum384(data)
+		return h[:], crypto.SHA384, 48
+	}
+	h := sha256.Sum256(data)
+	return h[:], crypto.SHA256, 32
+}
+
+// intToBytes left pads the big endian bytes of i to size.
+func intToBytes(i *big.Int, size int) []byte {
+	b := i.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
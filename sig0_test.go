@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testSig0Keys(t *testing.T) map[string]crypto.Signer {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{
+		"ed25519":   edKey,
+		"ecdsap256": p256Key,
+		"ecdsap384": p384Key,
+	}
+}
+
+func TestSig0SignVerifiedByMiekg(t *testing.T) {
+	for name, signer := range testSig0Keys(t) {
+		key, err := NewKEY("tenant-a.keys.example.", signer.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := testTsigMsg()
+		data, err := Sig0Sign(msg, key, signer, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		m := new(dns.Msg)
+		err = m.Unpack(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		sig := m.Extra[len(m.Extra)-1].(*dns.SIG)
+		k := &dns.KEY{DNSKEY: dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: key.Hdr.Name, Rrtype: dns.TypeKEY, Class: dns.ClassINET},
+			Flags:     key.Flags,
+			Protocol:  key.Protocol,
+			Algorithm: key.Algorithm,
+			PublicKey: base64.StdEncoding.EncodeToString(key.PublicKey),
+		}}
+		if k.KeyTag() != key.KeyTag() {
+			t.Errorf("%s: key tag = %d, want %d", name, key.KeyTag(), k.KeyTag())
+		}
+		err = sig.Verify(k, data)
+		if err != nil {
+			t.Errorf("%s: miekg rejected signature: %v", name, err)
+		}
+	}
+}
+
+func TestSig0VerifyMiekgSignature(t *testing.T) {
+	for name, signer := range testSig0Keys(t) {
+		key, err := NewKEY("tenant-a.keys.example.", signer.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var store MemorySig0KeyStore
+		err = store.AddKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := new(dns.Msg)
+		m.SetUpdate("example.")
+		sig := &dns.SIG{RRSIG: dns.RRSIG{
+			Algorithm:  key.Algorithm,
+			Expiration: uint32(time.Now().Add(time.Minute).Unix()),
+			Inception:  uint32(time.Now().Add(-time.Minute).Unix()),
+			KeyTag:     key.KeyTag(),
+			SignerName: key.Hdr.Name,
+		}}
+		data, err := sig.Sign(signer, m)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		signedBy, err := Sig0Verify(data, &store, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if signedBy != key {
+			t.Errorf("%s: verified with the wrong key", name)
+		}
+
+		data[5] ^= 0x01
+		_, err = Sig0Verify(data, &store, nil)
+		if err == nil {
+			t.Errorf("%s: tampered message verified", name)
+		}
+	}
+}
+
+func TestSig0UnknownSigner(t *testing.T) {
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewKEY("tenant-b.keys.example.", signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Sig0Sign(testTsigMsg(), key, signer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var store MemorySig0KeyStore
+	_, err = Sig0Verify(data, &store, nil)
+	if err != ErrSig0BadKey {
+		t.Errorf("err = %v, want %v", err, ErrSig0BadKey)
+	}
+}
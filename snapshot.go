@@ -0,0 +1,237 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// snapshotMagic starts a snapshot, followed by its version
+	snapshotMagic   = "SDNSSNAP"
+	snapshotVersion = 1
+)
+
+var ErrSnapshotFormat = errors.New("not a cache snapshot")
+
+// presenceCache is a Cache that tells whether it has an entry for a question,
+// stale or not, without counting a lookup.
+type presenceCache interface {
+	has(ctx context.Context, q Question) (bool, error)
+}
+
+// errSnapshotEntryTooLarge is a response that does not fit the 2 bytes of its length
+var errSnapshotEntryTooLarge = errors.New("response too large for a snapshot")
+
+// ExportCache writes a snapshot of the responses cached in c to w for ImportCache,
+// and returns how many it wrote. Responses are read from c and written one at a
+// time, so the cache never needs to fit in memory. A response too large to be
+// written is left out with a warning.
+//
+// A snapshot is the magic "SDNSSNAP", a version byte and the time it was taken in
+// Unix seconds as 8 bytes, then each response as a DNS message with the TTLs its
+// records have left, behind its length as 2 bytes as over TCP, and a zero length.
+func ExportCache(ctx context.Context, c Cache, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, len(snapshotMagic)+9)
+	copy(header, snapshotMagic)
+	header[len(snapshotMagic)] = snapshotVersion
+	binary.BigEndian.PutUint64(header[len(snapshotMagic)+1:], uint64(timeNow().Unix()))
+	_, err := bw.Write(header)
+	if err != nil {
+		return 0, fmt.Errorf("writing snapshot err: %v", err)
+	}
+
+	n := 0
+	var werr error
+	err = c.Iterate(ctx, func(q Question, m *Msg) bool {
+		werr = writeSnapshotEntry(bw, m)
+		if errors.Is(werr, errSnapshotEntryTooLarge) {
+			log.Printf("Warning: leaving %v out of the snapshot err: %v", q, werr)
+			werr = nil
+			return ctx.Err() == nil
+		}
+		if werr != nil {
+			return false
+		}
+		n++
+		return ctx.Err() == nil
+	})
+	if werr != nil {
+		return n, werr
+	}
+	if err != nil {
+		return n, fmt.Errorf("iterating cache err: %v", err)
+	}
+	if ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+
+	_, err = bw.Write([]byte{0, 0})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return n, fmt.Errorf("writing snapshot err: %v", err)
+	}
+	return n, nil
+}
+
+func writeSnapshotEntry(w io.Writer, m *Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return fmt.Errorf("packing %v err: %v", m.Question, err)
+	}
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("%w: %d bytes", errSnapshotEntryTooLarge, len(data))
+	}
+
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(data)))
+	_, err = w.Write(append(l[:], data...))
+	if err != nil {
+		return fmt.Errorf("writing snapshot err: %v", err)
+	}
+	return nil
+}
+
+// ImportCache stores the responses of a snapshot ExportCache wrote in c, their
+// TTLs less the time since it was taken, and returns how many it stored. Responses
+// that expired since are skipped, and so are questions c already has a response
+// to, stale or not, which is no older than the snapshot's. They are read and
+// stored one at a time.
+func ImportCache(ctx context.Context, c Cache, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotMagic)+9)
+	_, err := io.ReadFull(br, header)
+	if err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, ErrSnapshotFormat
+	}
+	if v := header[len(snapshotMagic)]; v != snapshotVersion {
+		return 0, fmt.Errorf("unknown snapshot version %d", v)
+	}
+	elapsed := timeNow().Unix() - int64(binary.BigEndian.Uint64(header[len(snapshotMagic)+1:]))
+	if elapsed < 0 {
+		elapsed = 0
+	} else if elapsed > maxCacheTtl {
+		elapsed = maxCacheTtl
+	}
+
+	n := 0
+	var l [2]byte
+	for {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+
+		_, err = io.ReadFull(br, l[:])
+		if err != nil {
+			return n, fmt.Errorf("snapshot truncated: %v", err)
+		}
+		if binary.BigEndian.Uint16(l[:]) == 0 {
+			return n, nil
+		}
+		data := make([]byte, binary.BigEndian.Uint16(l[:]))
+		_, err = io.ReadFull(br, data)
+		if err != nil {
+			return n, fmt.Errorf("snapshot truncated: %v", err)
+		}
+
+		m := new(Msg)
+		err = m.Unpack(data)
+		if err != nil {
+			return n, fmt.Errorf("unpacking snapshot entry err: %v", err)
+		}
+		if len(m.Question) != 1 || !ageSnapshotEntry(m, uint32(elapsed)) {
+			continue
+		}
+
+		q := m.Question[0]
+		cached, err := isCached(ctx, c, q)
+		if err != nil {
+			log.Printf("Warning: looking up %v before importing it err: %v", q, err)
+		}
+		if cached {
+			continue
+		}
+		if len(m.Ns) > 0 {
+			err = c.StoreNegative(ctx, q, m)
+		} else {
+			err = c.Store(ctx, q, m.Answer)
+		}
+		if err != nil {
+			return n, fmt.Errorf("storing %v err: %v", q, err)
+		}
+		n++
+	}
+}
+
+// isCached reports whether c has an entry for q, stale or not, without counting a
+// lookup where c can tell.
+func isCached(ctx context.Context, c Cache, q Question) (bool, error) {
+	if pc, ok := c.(presenceCache); ok {
+		return pc.has(ctx, q)
+	}
+	m, err := c.LookupStale(ctx, q)
+	return m != nil, err
+}
+
+// ageSnapshotEntry takes elapsed seconds off the TTLs of m, false if any record
+// expired, which the whole response expires with.
+func ageSnapshotEntry(m *Msg, elapsed uint32) bool {
+	for _, rrs := range [][]RR{m.Answer, m.Ns} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Ttl <= elapsed {
+				return false
+			}
+			h.Ttl -= elapsed
+		}
+	}
+	return true
+}
+
+// ExportCacheFile is ExportCache to the file at path, which is only replaced once
+// the snapshot is complete.
+func ExportCacheFile(ctx context.Context, c Cache, path string) (int, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return 0, fmt.Errorf("creating snapshot err: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	n, err := ExportCache(ctx, c, f)
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	err = f.Close()
+	if err != nil {
+		return n, fmt.Errorf("writing snapshot err: %v", err)
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return n, fmt.Errorf("replacing snapshot err: %v", err)
+	}
+	return n, nil
+}
+
+// ImportCacheFile is ImportCache from the file at path, for a warm start. A missing
+// file, as on the first start, imports nothing without an error.
+func ImportCacheFile(ctx context.Context, c Cache, path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("opening snapshot err: %v", err)
+	}
+	defer f.Close()
+	return ImportCache(ctx, c, f)
+}
@@ -0,0 +1,174 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheSnapshotRoundTrip(t *testing.T) {
+	src := startTestRedis(t)
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	www := testStoreA(t, src, "www.example.com.", 600)
+	testStoreA(t, src, "short.example.com.", 60)
+	unknown := Question{Name: "www.example.com.", QType: 65280, QClass: ClassINET}
+	err := src.Store(ctx, unknown, []RR{&RFC3597{Hdr: RR_Header{Name: unknown.Name, Rrtype: unknown.QType, Class: ClassINET, Ttl: 600}, Rdata: []byte{1, 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nx := Question{Name: "nothere.example.com.", QType: TypeA, QClass: ClassINET}
+	err = src.StoreNegative(ctx, nx, testNegativeResponse(nx, RcodeNameError, 3600, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := ExportCache(ctx, src, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("exported %d responses, want 4", n)
+	}
+
+	// imported two minutes later, the short entry has expired
+	setTestTime(t, now.Add(2*time.Minute))
+	dst := NewLRUCache(0, 0)
+	n, err = ImportCache(ctx, dst, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("imported %d responses, want 3", n)
+	}
+
+	entry, err := dst.Lookup(ctx, www)
+	if err != nil || entry == nil || entry.Ttl != 480 {
+		t.Errorf("www = %+v, %v, want 480s left", entry, err)
+	}
+	entry, err = dst.Lookup(ctx, unknown)
+	if err != nil || entry == nil || len(entry.Msg.Answer) != 1 {
+		t.Errorf("unknown type = %+v, %v", entry, err)
+	}
+	entry, err = dst.Lookup(ctx, nx)
+	if err != nil || entry == nil || entry.Msg.Rcode != RcodeNameError || entry.Ttl != 180 {
+		t.Errorf("nxdomain = %+v, %v, want 180s left", entry, err)
+	}
+}
+
+func TestImportCacheRejectsBadSnapshots(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRUCache(0, 0)
+	testStoreA(t, c, "www.example.com.", 600)
+	var buf bytes.Buffer
+	_, err := ExportCache(ctx, c, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ImportCache(ctx, NewLRUCache(0, 0), bytes.NewReader([]byte("not a snapshot at all")))
+	if err != ErrSnapshotFormat {
+		t.Errorf("bad magic err = %v", err)
+	}
+	_, err = ImportCache(ctx, NewLRUCache(0, 0), bytes.NewReader(buf.Bytes()[:buf.Len()-2]))
+	if err == nil {
+		t.Error("truncated snapshot imported")
+	}
+}
+
+func TestCacheSnapshotFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	n, err := ImportCacheFile(ctx, NewLRUCache(0, 0), path)
+	if err != nil || n != 0 {
+		t.Errorf("missing snapshot imported %d, %v", n, err)
+	}
+
+	c := NewLRUCache(0, 0)
+	q := testStoreA(t, c, "www.example.com.", 600)
+	_, err = ExportCacheFile(ctx, c, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := NewLRUCache(0, 0)
+	n, err = ImportCacheFile(ctx, dst, path)
+	if err != nil || n != 1 {
+		t.Fatalf("imported %d, %v", n, err)
+	}
+	if entry, _ := dst.Lookup(ctx, q); entry == nil {
+		t.Error("entry not imported")
+	}
+}
+
+func TestExportCacheSkipsOversizedResponses(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRUCache(0, 0)
+	testStoreA(t, c, "www.example.com.", 600)
+	big := Question{Name: "big.example.com.", QType: TypeTXT, QClass: ClassINET}
+	var txts []RR
+	for i := 0; i < 300; i++ {
+		txt := string(bytes.Repeat([]byte{byte('a' + i%26)}, 250)) + string(rune('a'+i/26))
+		txts = append(txts, &TXT{Hdr: RR_Header{Name: big.Name, Rrtype: TypeTXT, Class: ClassINET, Ttl: 600}, Txt: []string{txt}})
+	}
+	err := c.Store(ctx, big, txts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := ExportCache(ctx, c, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("exported %d responses, want 1", n)
+	}
+	n, err = ImportCache(ctx, NewLRUCache(0, 0), &buf)
+	if err != nil || n != 1 {
+		t.Errorf("imported %d responses, %v, want 1", n, err)
+	}
+}
+
+func TestImportCacheKeepsCachedResponses(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+	src := NewLRUCache(0, 0)
+	www := testStoreA(t, src, "www.example.com.", 600)
+	testStoreA(t, src, "mail.example.com.", 600)
+	var buf bytes.Buffer
+	_, err := ExportCache(ctx, src, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := buf.Bytes()
+
+	for name, dst := range map[string]Cache{"lru": NewLRUCache(0, 0), "redis": startTestRedis(t)} {
+		testStoreA(t, dst, www.Name, 3600)
+		before := dst.Stats()
+		n, err := ImportCache(ctx, dst, bytes.NewReader(snapshot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("%s imported %d responses, want 1", name, n)
+		}
+		// checking for cached responses is no lookup
+		after := dst.Stats()
+		if after.Hits != before.Hits || after.Misses != before.Misses || after.StaleHits != before.StaleHits || len(after.Types) != len(before.Types) {
+			t.Errorf("%s stats went from %+v to %+v", name, before, after)
+		}
+
+		entry, err := dst.Lookup(ctx, www)
+		if err != nil || entry == nil || entry.OrigTtl != 3600 {
+			t.Errorf("%s www = %+v, %v, want the response cached for 3600s", name, entry, err)
+		}
+	}
+}
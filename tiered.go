@@ -0,0 +1,180 @@
+package dns
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+)
+
+// TieredCache is a Cache keeping a local L1, such as an LRUCache, in front of a
+// redis shared by several nodes as L2. Entries stored in or found in L2 are copied
+// to L1 as they are there, TTLs clamped by its TtlPolicy, so they expire from both
+// at the same time. Changes are published for Listen on the other nodes to drop
+// their L1 copies.
+type TieredCache struct {
+	// stats come first, aligned for their atomic counters
+	stats cacheCounters
+
+	L1 Cache
+	L2 *RedisClient
+}
+
+// entryCache is a Cache that can take an entry found in another as it is there.
+type entryCache interface {
+	addEntry(q Question, entry *CacheEntry) error
+}
+
+func (c *TieredCache) Store(ctx context.Context, q Question, answers []RR) error {
+	replaced, err := c.L2.storeRedisCache(ctx, q, answers)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.stats.stores, 1)
+	err = c.fillL1(ctx, q)
+	if err != nil {
+		return err
+	}
+	return c.publishReplaced(ctx, q, replaced)
+}
+
+func (c *TieredCache) StoreNegative(ctx context.Context, q Question, resp *Msg) error {
+	replaced, err := c.L2.storeRedisNegativeCache(ctx, q, resp)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.stats.stores, 1)
+	err = c.fillL1(ctx, q)
+	if err != nil {
+		return err
+	}
+	return c.publishReplaced(ctx, q, replaced)
+}
+
+// fillL1 copies to L1 what L2 stored for q, with the TTLs its TtlPolicy left, or
+// drops the entry of L1 if L2 stored nothing.
+func (c *TieredCache) fillL1(ctx context.Context, q Question) error {
+	entry, err := c.L2.getRedisCache(ctx, q, false)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return c.L1.Delete(ctx, q)
+	}
+	return c.copyToL1(ctx, q, &entry.CacheEntry)
+}
+
+// copyToL1 stores entry, found in L2, in L1. L1 takes the entry as L2 has it, so
+// prefetching still sees its original TTL and hits; a plain Cache takes it with
+// the TTLs left.
+func (c *TieredCache) copyToL1(ctx context.Context, q Question, entry *CacheEntry) error {
+	if l1, ok := c.L1.(entryCache); ok {
+		return l1.addEntry(q, entry)
+	}
+	if len(entry.Msg.Ns) > 0 {
+		return c.L1.StoreNegative(ctx, q, entry.Msg)
+	}
+	return c.L1.Store(ctx, q, entry.Msg.Answer)
+}
+
+// publishReplaced tells the other nodes to drop their copies of the entry for q if
+// a store replaced one. Other nodes only copy entries from L2, which expire from
+// both together, so a new entry has no copies to drop.
+func (c *TieredCache) publishReplaced(ctx context.Context, q Question, replaced bool) error {
+	if !replaced {
+		return nil
+	}
+	return c.L2.PublishInvalidation(ctx, Invalidation{Kind: InvalidateQuestion, Question: q})
+}
+
+func (c *TieredCache) Lookup(ctx context.Context, q Question) (*CacheEntry, error) {
+	entry, err := c.L1.Lookup(ctx, q)
+	if err != nil {
+		log.Printf("Warning: looking up %v in l1 err: %v", q, err)
+	}
+	if entry != nil {
+		c.stats.lookup(q, entry.Msg)
+		return entry, nil
+	}
+
+	entry, err = c.L2.Lookup(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		c.stats.lookup(q, nil)
+		return nil, nil
+	}
+	c.stats.lookup(q, entry.Msg)
+
+	err = c.copyToL1(ctx, q, entry)
+	if err != nil {
+		log.Printf("Warning: copying %v to l1 err: %v", q, err)
+	}
+	return entry, nil
+}
+
+func (c *TieredCache) LookupStale(ctx context.Context, q Question) (*Msg, error) {
+	m, err := c.L1.LookupStale(ctx, q)
+	if err != nil {
+		log.Printf("Warning: looking up stale %v in l1 err: %v", q, err)
+	}
+	if m != nil {
+		return m, nil
+	}
+	return c.L2.LookupStale(ctx, q)
+}
+
+// has reports whether L2, which has every entry L1 has, has one for q.
+func (c *TieredCache) has(ctx context.Context, q Question) (bool, error) {
+	return c.L2.has(ctx, q)
+}
+
+func (c *TieredCache) Delete(ctx context.Context, q Question) error {
+	err := c.L2.Delete(ctx, q)
+	if err != nil {
+		return err
+	}
+	err = c.L1.Delete(ctx, q)
+	if err != nil {
+		return err
+	}
+	return c.L2.PublishInvalidation(ctx, Invalidation{Kind: InvalidateQuestion, Question: q})
+}
+
+func (c *TieredCache) Purge(ctx context.Context, inv Invalidation) error {
+	err := c.L2.Purge(ctx, inv)
+	if err != nil {
+		return err
+	}
+	err = c.L1.Purge(ctx, inv)
+	if err != nil {
+		return err
+	}
+	return c.L2.PublishInvalidation(ctx, inv)
+}
+
+// Stats returns the lookups and stores of c, with the stale hits, evictions and
+// decode errors of both tiers. Each tier counts its own lookups in its Stats.
+func (c *TieredCache) Stats() CacheStats {
+	s := c.stats.snapshot()
+	for _, tier := range []CacheStats{c.L1.Stats(), c.L2.Stats()} {
+		s.StaleHits += tier.StaleHits
+		s.Evictions += tier.Evictions
+		s.DecodeErrors += tier.DecodeErrors
+	}
+	return s
+}
+
+func (c *TieredCache) Iterate(ctx context.Context, fn func(q Question, m *Msg) bool) error {
+	return c.L2.Iterate(ctx, fn)
+}
+
+// Listen drops the L1 copies of the entries other nodes change, until ctx is done.
+func (c *TieredCache) Listen(ctx context.Context) error {
+	return c.L2.SubscribeInvalidations(ctx, func(inv Invalidation) {
+		err := c.L1.Purge(ctx, inv)
+		if err != nil {
+			log.Printf("Warning: purging %+v from l1 err: %v", inv, err)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package dns
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// startTestTieredCaches returns the caches of two nodes sharing one redis.
+func startTestTieredCaches(t *testing.T) (*TieredCache, *TieredCache) {
+	l2 := startTestRedis(t)
+	other := &RedisClient{}
+	err := other.InitRedis(context.Background(), l2.Options().Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(other.CloseRedis)
+
+	return &TieredCache{L1: NewLRUCache(0, 0), L2: l2}, &TieredCache{L1: NewLRUCache(0, 0), L2: other}
+}
+
+func TestTieredCacheCopiesRemainingTtl(t *testing.T) {
+	a, b := startTestTieredCaches(t)
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	q := testStoreA(t, a, "www.example.com.", 60)
+
+	setTestTime(t, now.Add(20*time.Second))
+	entry, err := b.Lookup(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Ttl != 40 {
+		t.Fatalf("l2 entry = %+v", entry)
+	}
+
+	setTestTime(t, now.Add(30*time.Second))
+	entry, err = b.L1.Lookup(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Ttl != 30 {
+		t.Fatalf("l1 entry = %+v, want the l2 ttl counting down", entry)
+	}
+	// prefetching sees the entry as l2 had it
+	if entry.OrigTtl != 60 || entry.Hits != 2 {
+		t.Errorf("l1 entry has orig ttl %d and %d hits, want 60 and 2", entry.OrigTtl, entry.Hits)
+	}
+
+	setTestTime(t, now.Add(61*time.Second))
+	if entry, _ := b.L1.Lookup(ctx, q); entry != nil {
+		t.Errorf("l1 entry outlived l2: %+v", entry)
+	}
+}
+
+func TestTieredCacheInvalidatesOtherNodes(t *testing.T) {
+	a, b := startTestTieredCaches(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := testStoreA(t, a, "www.example.com.", 60)
+	if entry, _ := b.Lookup(ctx, q); entry == nil {
+		t.Fatal("entry not found in l2")
+	}
+
+	go b.Listen(ctx)
+	waitSubscribed(t, a.L2, 1)
+
+	err := a.Delete(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if entry, _ := b.L1.Lookup(ctx, q); entry == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("l1 entry of the other node not invalidated")
+}
+
+func TestTieredCachePurgesZoneOnOtherNodes(t *testing.T) {
+	a, b := startTestTieredCaches(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inZone := testStoreA(t, a, "www.example.com.", 60)
+	outside := testStoreA(t, a, "www.example.net.", 60)
+	for _, q := range []Question{inZone, outside} {
+		if entry, _ := b.Lookup(ctx, q); entry == nil {
+			t.Fatalf("%v not found in l2", q)
+		}
+	}
+
+	go b.Listen(ctx)
+	waitSubscribed(t, a.L2, 1)
+
+	err := a.Purge(ctx, Invalidation{Kind: InvalidateZone, Question: Question{Name: "example.com."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := a.L2.Lookup(ctx, inZone); entry != nil {
+		t.Error("purged entry kept in l2")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if entry, _ := b.L1.Lookup(ctx, inZone); entry == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if entry, _ := b.L1.Lookup(ctx, inZone); entry != nil {
+		t.Error("l1 entry of the other node not purged")
+	}
+	if entry, _ := b.L1.Lookup(ctx, outside); entry == nil {
+		t.Error("entry outside the zone purged")
+	}
+}
+
+func TestTieredCachePublishesOnlyReplacements(t *testing.T) {
+	a, _ := startTestTieredCaches(t)
+	ctx := context.Background()
+
+	sub := a.L2.Subscribe(ctx, a.L2.invalidationChannel())
+	defer sub.Close()
+	_, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := func() bool {
+		select {
+		case <-sub.Channel():
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	testStoreA(t, a, "www.example.com.", 60)
+	if published() {
+		t.Error("storing a new entry published an invalidation")
+	}
+	testStoreA(t, a, "www.example.com.", 60)
+	if !published() {
+		t.Error("replacing an entry published no invalidation")
+	}
+}
+
+func TestTieredCacheTtlPolicy(t *testing.T) {
+	a, _ := startTestTieredCaches(t)
+	ctx := context.Background()
+	a.L2.TtlPolicy = &TtlPolicy{TtlLimits: TtlLimits{Max: 60}}
+
+	q := testStoreA(t, a, "www.example.com.", 86400)
+	entry, err := a.L1.Lookup(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Ttl != 60 || entry.Msg.Answer[0].Header().Ttl != 60 {
+		t.Errorf("l1 entry = %+v, want it clamped to 60s as in l2", entry)
+	}
+
+	nx := Question{Name: "nothere.example.com.", QType: TypeA, QClass: ClassINET}
+	err = a.StoreNegative(ctx, nx, testNegativeResponse(nx, RcodeNameError, 3600, 3600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err = a.L1.Lookup(ctx, nx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Msg.Rcode != RcodeNameError || entry.Ttl != 60 {
+		t.Errorf("l1 negative entry = %+v, want it clamped to 60s as in l2", entry)
+	}
+}
@@ -0,0 +1,457 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TSIG algorithm names (RFC 8945)
+const (
+	HmacSHA1   = "hmac-sha1."
+	HmacSHA256 = "hmac-sha256."
+	HmacSHA512 = "hmac-sha512."
+)
+
+const DefaultTsigFudge = 300
+
+var (
+	ErrTsigMissing = errors.New("message has no tsig")
+	ErrTsigBadKey  = errors.New("bad tsig key")
+	ErrTsigBadSig  = errors.New("bad tsig signature")
+	ErrTsigBadTime = errors.New("bad tsig time")
+
+	errNoExtra = errors.New("message has no known additional record")
+)
+
+var timeNow = time.Now
+
+var tsigHashes = map[string]func() hash.Hash{
+	HmacSHA1:   sha1.New,
+	HmacSHA256: sha256.New,
+	HmacSHA512: sha512.New,
+}
+
+// TsigKey is a shared secret as it appears in config, the secret being base64 in JSON.
+type TsigKey struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	Secret    []byte `json:"secret"`
+}
+
+func (key *TsigKey) hash() (func() hash.Hash, error) {
+	h, ok := tsigHashes[CanonicalName(key.Algorithm)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported tsig algorithm %s", key.Algorithm)
+	}
+	return h, nil
+}
+
+// Sign adds a TSIG for key to msg unless it already carries one and returns the signed wire data and its MAC.
+func (key *TsigKey) Sign(msg *Msg, requestMAC []byte) ([]byte, []byte, error) {
+	if msg.IsTsig() == nil {
+		msg.SetTsig(key.Name, key.Algorithm, DefaultTsigFudge, timeNow().Unix())
+	}
+	return TsigSign(msg, key, requestMAC, false)
+}
+
+type TsigKeyRing interface {
+	GetKey(name string) (*TsigKey, error)
+}
+
+// MemoryTsigKeyRing keeps keys in memory, indexed by canonical key name.
+type MemoryTsigKeyRing struct {
+	mu   sync.RWMutex
+	keys map[string]*TsigKey
+}
+
+func (ring *MemoryTsigKeyRing) AddKey(key TsigKey) error {
+	if _, err := key.hash(); err != nil {
+		return err
+	}
+	if len(key.Secret) == 0 {
+		return fmt.Errorf("empty secret for tsig key %s", key.Name)
+	}
+	key.Name = CanonicalName(key.Name)
+	key.Algorithm = CanonicalName(key.Algorithm)
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	if ring.keys == nil {
+		ring.keys = make(map[string]*TsigKey)
+	}
+	ring.keys[key.Name] = &key
+	return nil
+}
+
+func (ring *MemoryTsigKeyRing) RemoveKey(name string) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	delete(ring.keys, CanonicalName(name))
+}
+
+func (ring *MemoryTsigKeyRing) GetKey(name string) (*TsigKey, error) {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+	key, ok := ring.keys[CanonicalName(name)]
+	if !ok {
+		return nil, ErrTsigBadKey
+	}
+	return key, nil
+}
+
+// LoadKeys adds every key of a JSON array such as
+// [{"name":"xfr.","algorithm":"hmac-sha256.","secret":"<base64>"}].
+func (ring *MemoryTsigKeyRing) LoadKeys(data []byte) error {
+	var keys []TsigKey
+	err := json.Unmarshal(data, &keys)
+	if err != nil {
+		return fmt.Errorf("unmarshaling tsig keys err: %v", err)
+	}
+	for _, key := range keys {
+		err = ring.AddKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetTsig appends a TSIG RR to msg which TsigSign fills in.
+func (msg *Msg) SetTsig(keyName, algorithm string, fudge uint16, timeSigned int64) *Msg {
+	msg.Extra = append(msg.Extra, &TSIG{
+		Hdr: RR_Header{
+			Name:   CanonicalName(keyName),
+			Rrtype: TypeTSIG,
+			Class:  ClassANY,
+			Ttl:    0,
+		},
+		Algorithm:  CanonicalName(algorithm),
+		TimeSigned: uint64(timeSigned),
+		Fudge:      fudge,
+	})
+	return msg
+}
+
+// IsTsig returns the TSIG RR of msg, which must be the last additional record, or nil.
+func (msg *Msg) IsTsig() *TSIG {
+	if len(msg.Extra) == 0 {
+		return nil
+	}
+	if t, ok := msg.Extra[len(msg.Extra)-1].(*TSIG); ok {
+		return t
+	}
+	return nil
+}
+
+// TsigSign computes the MAC over msg, whose TSIG must have been added with SetTsig,
+// and returns the signed wire data and the MAC. requestMAC is the MAC of the request
+// when signing a response, timersOnly is set for the later messages of a TCP stream.
+func TsigSign(msg *Msg, key *TsigKey, requestMAC []byte, timersOnly bool) ([]byte, []byte, error) {
+	return tsigSign(msg, key, requestMAC, nil, timersOnly)
+}
+
+func tsigSign(msg *Msg, key *TsigKey, requestMAC []byte, pending []byte, timersOnly bool) ([]byte, []byte, error) {
+	rr := msg.IsTsig()
+	if rr == nil {
+		return nil, nil, ErrTsigMissing
+	}
+	h, err := key.hash()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unsigned := *msg
+	unsigned.Extra = msg.Extra[:len(msg.Extra)-1]
+	buf, err := unsigned.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rr.OrigId = msg.Id
+	rr.MAC = nil
+	digest, err := tsigDigest(append(CloneSlice(pending), buf...), rr, requestMAC, timersOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	mac := hmac.New(h, key.Secret)
+	mac.Write(digest)
+	rr.MAC = mac.Sum(nil)
+	rr.MACSize = uint16(len(rr.MAC))
+
+	buf, err = msg.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, rr.MAC, nil
+}
+
+// TsigVerify checks the MAC and the time of the signed wire message data and returns its TSIG.
+func TsigVerify(data []byte, key *TsigKey, requestMAC []byte, timersOnly bool) (*TSIG, error) {
+	buf, rr, err := stripTsig(data)
+	if err != nil {
+		return nil, err
+	}
+	return rr, tsigVerify(buf, rr, key, requestMAC, timersOnly)
+}
+
+// TsigVerifyWithKeyRing is TsigVerify with the key looked up in ring by the TSIG owner name.
+func TsigVerifyWithKeyRing(data []byte, ring TsigKeyRing, requestMAC []byte, timersOnly bool) (*TSIG, error) {
+	buf, rr, err := stripTsig(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ring.GetKey(rr.Hdr.Name)
+	if err != nil {
+		return rr, err
+	}
+	return rr, tsigVerify(buf, rr, key, requestMAC, timersOnly)
+}
+
+func tsigVerify(buf []byte, rr *TSIG, key *TsigKey, requestMAC []byte, timersOnly bool) error {
+	if !strings.EqualFold(rr.Hdr.Name, Fqdn(key.Name)) || !strings.EqualFold(rr.Algorithm, Fqdn(key.Algorithm)) {
+		return ErrTsigBadKey
+	}
+	h, err := key.hash()
+	if err != nil {
+		return ErrTsigBadKey
+	}
+
+	digest, err := tsigDigest(buf, rr, requestMAC, timersOnly)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(h, key.Secret)
+	mac.Write(digest)
+	expected := mac.Sum(nil)
+
+	// truncated MACs are allowed down to half the hash size but never below 10 bytes
+	l := len(rr.MAC)
+	if l > len(expected) || l < 10 || l < len(expected)/2 {
+		return ErrTsigBadSig
+	}
+	if !hmac.Equal(rr.MAC, expected[:l]) {
+		return ErrTsigBadSig
+	}
+
+	now := uint64(timeNow().Unix())
+	diff := now - rr.TimeSigned
+	if rr.TimeSigned > now {
+		diff = rr.TimeSigned - now
+	}
+	if diff > uint64(rr.Fudge) {
+		return ErrTsigBadTime
+	}
+
+	return nil
+}
+
+// stripTsig splits the TSIG off the wire message data and restores the header the
+// message had before signing.
+func stripTsig(data []byte) ([]byte, *TSIG, error) {
+	buf, last, err := splitLastExtra(data)
+	if err == errNoExtra {
+		return nil, nil, ErrTsigMissing
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	rr, ok := last.(*TSIG)
+	if !ok {
+		return nil, nil, ErrTsigMissing
+	}
+
+	binary.BigEndian.PutUint16(buf[0:], rr.OrigId)
+	return buf, rr, nil
+}
+
+// splitLastExtra returns a copy of the wire message data without its last additional
+// record, with ARCOUNT adjusted, and that record.
+func splitLastExtra(data []byte) ([]byte, RR, error) {
+	var dh Header
+	off, err := dh.unpack(data, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dh.Arcount == 0 {
+		return nil, nil, errNoExtra
+	}
+
+	for i := 0; i < int(dh.Qdcount); i++ {
+		_, off, err = unpackDomainName(data, off)
+		if err != nil {
+			return nil, nil, err
+		}
+		off += 4
+	}
+	_, off, err = unpackRRSlice(data, off, int(dh.Ancount)+int(dh.Nscount)+int(dh.Arcount)-1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lastOff := off
+	rrs, _, err := unpackRRSlice(data, off, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rrs) != 1 {
+		return nil, nil, errNoExtra
+	}
+
+	buf := CloneSlice(data[:lastOff])
+	binary.BigEndian.PutUint16(buf[10:], dh.Arcount-1)
+	return buf, rrs[0], nil
+}
+
+// tsigDigest builds the data the MAC is computed over: the prior MAC, the message
+// without its TSIG, and the TSIG variables (or only the timers).
+func tsigDigest(buf []byte, rr *TSIG, requestMAC []byte, timersOnly bool) ([]byte, error) {
+	var err error
+
+	vars := make([]byte, getDomainNameLen(rr.Hdr.Name)+getDomainNameLen(rr.Algorithm)+20+len(rr.OtherData))
+	off := 0
+	if !timersOnly {
+		off, err = packDomainName(CanonicalName(rr.Hdr.Name), vars, off, make(map[string]uint16))
+		if err != nil {
+			return nil, err
+		}
+		off, err = packUint16(ClassANY, vars, off)
+		if err != nil {
+			return nil, err
+		}
+		off, err = packUint32(0, vars, off)
+		if err != nil {
+			return nil, err
+		}
+		off, err = packDomainName(CanonicalName(rr.Algorithm), vars, off, make(map[string]uint16))
+		if err != nil {
+			return nil, err
+		}
+	}
+	off, err = packUint48(rr.TimeSigned, vars, off)
+	if err != nil {
+		return nil, err
+	}
+	off, err = packUint16(rr.Fudge, vars, off)
+	if err != nil {
+		return nil, err
+	}
+	if !timersOnly {
+		off, err = packUint16(rr.Error, vars, off)
+		if err != nil {
+			return nil, err
+		}
+		off, err = packUint16(uint16(len(rr.OtherData)), vars, off)
+		if err != nil {
+			return nil, err
+		}
+		off, err = packBytes(rr.OtherData, vars, off)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var digest []byte
+	if len(requestMAC) > 0 {
+		digest = make([]byte, 2, 2+len(requestMAC)+len(buf)+off)
+		binary.BigEndian.PutUint16(digest, uint16(len(requestMAC)))
+		digest = append(digest, requestMAC...)
+	}
+	digest = append(digest, buf...)
+	digest = append(digest, vars[:off]...)
+	return digest, nil
+}
+
+// TsigStream signs or verifies the messages of one TCP transfer. The first message
+// covers the request MAC and all TSIG variables, every later one the previous MAC
+// and only the timers (RFC 8945 section 5.3.1). Unsigned messages in between are
+// folded into the digest of the next signed one.
+type TsigStream struct {
+	Key        *TsigKey
+	RequestMAC []byte
+
+	prevMAC  []byte
+	pending  []byte
+	unsigned int
+}
+
+// maxTsigUnsigned is how many messages in a row may come without a TSIG.
+const maxTsigUnsigned = 99
+
+func (s *TsigStream) Sign(msg *Msg) ([]byte, error) {
+	if msg.IsTsig() == nil {
+		msg.SetTsig(s.Key.Name, s.Key.Algorithm, DefaultTsigFudge, timeNow().Unix())
+	}
+
+	var buf, mac []byte
+	var err error
+	if s.prevMAC == nil {
+		buf, mac, err = TsigSign(msg, s.Key, s.RequestMAC, false)
+	} else {
+		buf, mac, err = tsigSign(msg, s.Key, s.prevMAC, s.pending, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.prevMAC = mac
+	s.pending = nil
+	s.unsigned = 0
+	return buf, nil
+}
+
+// PackUnsigned packs a message sent without TSIG, which the next signed message covers.
+func (s *TsigStream) PackUnsigned(msg *Msg) ([]byte, error) {
+	if s.prevMAC == nil {
+		return nil, fmt.Errorf("first message of a tsig stream must be signed")
+	}
+	if s.unsigned++; s.unsigned > maxTsigUnsigned {
+		return nil, fmt.Errorf("more than %d unsigned messages in tsig stream", maxTsigUnsigned)
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	s.pending = append(s.pending, buf...)
+	return buf, nil
+}
+
+func (s *TsigStream) Verify(data []byte) error {
+	buf, rr, err := stripTsig(data)
+	if err == ErrTsigMissing {
+		if s.prevMAC == nil {
+			return ErrTsigMissing
+		}
+		if s.unsigned++; s.unsigned > maxTsigUnsigned {
+			return fmt.Errorf("more than %d unsigned messages in tsig stream", maxTsigUnsigned)
+		}
+		s.pending = append(s.pending, data...)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.prevMAC == nil {
+		err = tsigVerify(buf, rr, s.Key, s.RequestMAC, false)
+	} else {
+		err = tsigVerify(append(s.pending, buf...), rr, s.Key, s.prevMAC, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.prevMAC = rr.MAC
+	s.pending = nil
+	s.unsigned = 0
+	return nil
+}
@@ -0,0 +1,115 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var testTsigKey = &TsigKey{
+	Name:      "xfr.example.",
+	Algorithm: HmacSHA256,
+	Secret:    []byte("0123456789abcdef0123456789abcdef"),
+}
+
+func testTsigMsg() *Msg {
+	msg := &Msg{
+		MsgHdr: MsgHdr{Id: 4242, Response: true},
+		Answer: []RR{
+			&A{
+				Hdr: RR_Header{Name: "www.example.", Rrtype: TypeA, Class: ClassINET, Ttl: 60, Rdlength: 4},
+				A:   net.IP{192, 0, 2, 1},
+			},
+		},
+	}
+	msg.SetQuestion("www.example.", TypeA)
+	return msg
+}
+
+func TestTsigSignVerifiedByMiekg(t *testing.T) {
+	msg := testTsigMsg()
+	msg.SetTsig(testTsigKey.Name, testTsigKey.Algorithm, DefaultTsigFudge, time.Now().Unix())
+
+	data, _, err := TsigSign(msg, testTsigKey, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dns.TsigVerify(data, base64.StdEncoding.EncodeToString(testTsigKey.Secret), "", false)
+	if err != nil {
+		t.Fatalf("miekg rejected signature: %v", err)
+	}
+}
+
+func TestTsigVerifyMiekgSignature(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.", dns.TypeA)
+	m.SetTsig(testTsigKey.Name, dns.HmacSHA256, DefaultTsigFudge, time.Now().Unix())
+	data, mac, err := dns.TsigGenerate(m, base64.StdEncoding.EncodeToString(testTsigKey.Secret), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ring MemoryTsigKeyRing
+	err = ring.AddKey(*testTsigKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := TsigVerifyWithKeyRing(data, &ring, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(rr.MAC) != mac {
+		t.Errorf("MAC = %x, want %s", rr.MAC, mac)
+	}
+
+	data[len(data)-30] ^= 0xFF
+	_, err = TsigVerifyWithKeyRing(data, &ring, nil, false)
+	if err != ErrTsigBadSig {
+		t.Errorf("tampered message: err = %v, want %v", err, ErrTsigBadSig)
+	}
+}
+
+func TestTsigBadTime(t *testing.T) {
+	msg := testTsigMsg()
+	msg.SetTsig(testTsigKey.Name, testTsigKey.Algorithm, 10, time.Now().Add(-time.Minute).Unix())
+	data, _, err := TsigSign(msg, testTsigKey, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = TsigVerify(data, testTsigKey, nil, false)
+	if err != ErrTsigBadTime {
+		t.Errorf("err = %v, want %v", err, ErrTsigBadTime)
+	}
+}
+
+func TestTsigStream(t *testing.T) {
+	requestMAC := []byte("request mac from the axfr query")
+	signer := TsigStream{Key: testTsigKey, RequestMAC: requestMAC}
+	verifier := TsigStream{Key: testTsigKey, RequestMAC: requestMAC}
+
+	for i := 0; i < 4; i++ {
+		msg := testTsigMsg()
+		var data []byte
+		var err error
+		if i == 2 {
+			// an unsigned message in the middle of the stream
+			data, err = signer.PackUnsigned(msg)
+		} else {
+			data, err = signer.Sign(msg)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = verifier.Verify(data)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package dns
+
+// maxCacheTtl is the largest TTL there is, larger ones meaning 0 (RFC 2181 section 8).
+const maxCacheTtl = 1<<31 - 1
+
+// TtlLimits are the bounds of a TTL, 0 leaving it unbounded on that side.
+type TtlLimits struct {
+	Min, Max uint32
+}
+
+// TtlPolicy clamps the TTLs records are cached for. The limits of a record are
+// those of the longest zone in Zones its owner is in, else of its type in Types,
+// else the defaults.
+type TtlPolicy struct {
+	TtlLimits
+	// Types override the defaults for records of a type
+	Types map[uint16]TtlLimits
+	// Zones override the defaults and Types for records in a zone and below
+	Zones map[string]TtlLimits
+}
+
+// Clamp returns ttl, the TTL of rr, within its limits. A nil policy only zeroes TTLs
+// over 2^31-1.
+func (p *TtlPolicy) Clamp(rr RR, ttl uint32) uint32 {
+	if ttl > maxCacheTtl {
+		ttl = 0
+	}
+	if p == nil {
+		return ttl
+	}
+	limits := p.limits(rr)
+	if ttl < limits.Min {
+		ttl = limits.Min
+	}
+	if limits.Max > 0 && ttl > limits.Max {
+		ttl = limits.Max
+	}
+	return ttl
+}
+
+// CacheTtl returns the TTL records cached together are kept for: the smallest of
+// their clamped TTLs.
+func (p *TtlPolicy) CacheTtl(rrs []RR) uint32 {
+	var ttl uint32
+	for i, rr := range rrs {
+		clamped := p.Clamp(rr, rr.Header().Ttl)
+		if i == 0 || clamped < ttl {
+			ttl = clamped
+		}
+	}
+	return ttl
+}
+
+// ceiling returns ttl, what is left of the TTL of a cached rr, no more than its
+// maximum, so lowering one takes effect on what is already cached.
+func (p *TtlPolicy) ceiling(rr RR, ttl uint32) uint32 {
+	if p == nil {
+		return ttl
+	}
+	if max := p.limits(rr).Max; max > 0 && ttl > max {
+		return max
+	}
+	return ttl
+}
+
+func (p *TtlPolicy) limits(rr RR) TtlLimits {
+	h := rr.Header()
+	labels := -1
+	var limits TtlLimits
+	for zone, l := range p.Zones {
+		if n := CountLabels(zone); n > labels && IsSubDomain(zone, h.Name) {
+			labels, limits = n, l
+		}
+	}
+	if labels >= 0 {
+		return limits
+	}
+	if limits, ok := p.Types[h.Rrtype]; ok {
+		return limits
+	}
+	return p.TtlLimits
+}
+
+// remainingTtl returns the seconds left at now until expires, 0 once it is past.
+func remainingTtl(expires float64, now int64) uint32 {
+	left := int64(expires) - now
+	if left <= 0 {
+		return 0
+	}
+	if left > maxCacheTtl {
+		return maxCacheTtl
+	}
+	return uint32(left)
+}
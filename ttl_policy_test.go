@@ -0,0 +1,77 @@
+package dns
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTtlPolicyClamp(t *testing.T) {
+	p := &TtlPolicy{
+		TtlLimits: TtlLimits{Min: 30, Max: 3600},
+		Types:     map[uint16]TtlLimits{TypeNS: {Max: 86400}},
+		Zones: map[string]TtlLimits{
+			"example.com.":      {Max: 300},
+			"long.example.com.": {Min: 600},
+		},
+	}
+	tests := []struct {
+		rr   RR
+		ttl  uint32
+		want uint32
+	}{
+		{testRR("www.other.net.", TypeA, "192.0.2.1"), 5, 30},
+		{testRR("www.other.net.", TypeA, "192.0.2.1"), 7200, 3600},
+		{testRR("other.net.", TypeNS, "ns.other.net."), 7200, 7200},
+		{testRR("other.net.", TypeNS, "ns.other.net."), 5, 5},
+		// the zone wins over the type
+		{testRR("example.com.", TypeNS, "ns1.example.com."), 7200, 300},
+		// the longest zone wins
+		{testRR("www.long.example.com.", TypeA, "192.0.2.1"), 60, 600},
+		// too large to be meant
+		{testRR("www.other.net.", TypeA, "192.0.2.1"), 1 << 31, 30},
+	}
+	for _, tt := range tests {
+		if got := p.Clamp(tt.rr, tt.ttl); got != tt.want {
+			t.Errorf("clamp %v with ttl %d = %d, want %d", tt.rr, tt.ttl, got, tt.want)
+		}
+	}
+
+	var none *TtlPolicy
+	if got := none.Clamp(testRR("www.other.net.", TypeA, "192.0.2.1"), 1<<31); got != 0 {
+		t.Errorf("nil policy kept ttl %d over 2^31-1", got)
+	}
+}
+
+func TestRedisTtlPolicy(t *testing.T) {
+	client := startTestRedis(t)
+	client.TtlPolicy = &TtlPolicy{TtlLimits: TtlLimits{Min: 60, Max: 600}}
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, now)
+
+	short := testStoreA(t, client, "short.example.com.", 5)
+	long := testStoreA(t, client, "long.example.com.", 86400)
+
+	setTestTime(t, now.Add(30*time.Second))
+	rrs, err := client.GetRedisCacheByKey(ctx, short)
+	if err != nil || len(rrs) != 1 || rrs[0].Header().Ttl != 30 {
+		t.Errorf("short entry = %v, %v, want it kept for the minimum", rrs, err)
+	}
+
+	// lowering the maximum caps what is already cached
+	client.TtlPolicy.Max = 100
+	rrs, err = client.GetRedisCacheByKey(ctx, long)
+	if err != nil || len(rrs) != 1 || rrs[0].Header().Ttl != 100 {
+		t.Errorf("long entry = %v, %v, want its ttl capped", rrs, err)
+	}
+}
+
+func TestRemainingTtl(t *testing.T) {
+	if got := remainingTtl(100, 200); got != 0 {
+		t.Errorf("past expiry left %d", got)
+	}
+	if got := remainingTtl(300, 200); got != 100 {
+		t.Errorf("left %d, want 100", got)
+	}
+}
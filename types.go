@@ -22,11 +22,24 @@ const (
 	TypePTR   uint16 = 12
 	TypeMX    uint16 = 15
 	TypeTXT   uint16 = 16
+	TypeSIG   uint16 = 24
+	TypeKEY   uint16 = 25
 	TypeAAAA  uint16 = 28
+	TypeTSIG  uint16 = 250
+	TypeANY   uint16 = 255
+)
+
+const (
+	// KEY.Algorithm and SIG.Algorithm
+
+	ECDSAP256SHA256 uint8 = 13
+	ECDSAP384SHA384 uint8 = 14
+	ED25519         uint8 = 15
 )
 
 const (
 	ClassINET = 1
+	ClassANY  = 255
 )
 
 const (
@@ -36,6 +49,12 @@ const (
 	RcodeNameError      = 3
 	RcodeNotImplemented = 4
 	RcodeRefused        = 5
+	RcodeNotAuth        = 9
+
+	// TSIG.Error
+	RcodeBadSig  = 16
+	RcodeBadKey  = 17
+	RcodeBadTime = 18
 )
 
 var TypeToRR = map[uint16]func() RR{
@@ -47,4 +66,15 @@ var TypeToRR = map[uint16]func() RR{
 	TypePTR:   func() RR { return new(PTR) },
 	TypeMX:    func() RR { return new(MX) },
 	TypeTXT:   func() RR { return new(TXT) },
+	TypeSIG:   func() RR { return new(SIG) },
+	TypeKEY:   func() RR { return new(KEY) },
+	TypeTSIG:  func() RR { return new(TSIG) },
+}
+
+// newRR returns an empty record of rrtype, an RFC3597 for types without their own.
+func newRR(rrtype uint16) RR {
+	if rrFunc, ok := TypeToRR[rrtype]; ok {
+		return rrFunc()
+	}
+	return new(RFC3597)
 }
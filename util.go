@@ -1,5 +1,7 @@
 package dns
 
+import "strings"
+
 func CloneSlice[E any, S ~[]E](s S) S {
 	if s == nil {
 		return nil
@@ -7,3 +9,39 @@ func CloneSlice[E any, S ~[]E](s S) S {
 
 	return append(S(nil), s...)
 }
+
+// Fqdn returns name with a trailing dot, the form every packed name is expected in.
+func Fqdn(name string) string {
+	if IsFqdn(name) {
+		return name
+	}
+	return name + "."
+}
+
+func IsFqdn(name string) bool {
+	return strings.HasSuffix(name, ".")
+}
+
+// CanonicalName returns the lowercase fully qualified form of name.
+func CanonicalName(name string) string {
+	return strings.ToLower(Fqdn(name))
+}
+
+// IsSubDomain reports whether child is parent or a name below it, case-insensitively.
+func IsSubDomain(parent, child string) bool {
+	parent = CanonicalName(parent)
+	child = CanonicalName(child)
+	if parent == "." || parent == child {
+		return true
+	}
+	return strings.HasSuffix(child, "."+parent)
+}
+
+// CountLabels returns the number of labels of name, 0 for the root.
+func CountLabels(name string) int {
+	name = Fqdn(name)
+	if name == "." {
+		return 0
+	}
+	return strings.Count(name, ".")
+}